@@ -1,49 +1,309 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"container/list"
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"embed"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"html"
+	"html/template"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
 	"image/png"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/http/pprof"
+	"net/textproto"
+	"net/url"
 	"os"
 	"os/signal"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
+	texttemplate "text/template"
 	"time"
+	"unicode"
 
 	"github.com/boombuler/barcode"
 	"github.com/boombuler/barcode/code128"
+	"github.com/boombuler/barcode/qr"
 	"github.com/jlaffaye/ftp"
+	"github.com/klippa-app/go-pdfium"
+	"github.com/klippa-app/go-pdfium/requests"
+	"github.com/klippa-app/go-pdfium/webassembly"
+	"github.com/makiuchi-d/gozxing"
+	"github.com/makiuchi-d/gozxing/oned"
+	"github.com/makiuchi-d/gozxing/qrcode"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+	"github.com/pires/go-proxyproto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/net/netutil"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 type key int
 
+// version : set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+const serviceName = "goVetSheetServer"
+
+// startTime : used to report uptime
+var startTime = time.Now()
+
+// stats : counters reported by /status, updated with atomics
+var stats struct {
+	requests           int64
+	inFlight           int64
+	fallbacksSucceeded int64
+	fallbacksFailed    int64
+}
+
 const (
 	requestIDKey key = 0
 )
 
 var (
-	listenAddr string
-	healthy    int32
-	directory  string
-	ftpClient  ftpStruc
-	logger     *log.Logger
+	healthy int32
+	// shuttingDown : set once graceful shutdown starts
+	shuttingDown int32
+	logger       *log.Logger
+
+	// quotaMu : serializes eviction and writes under maxDirBytes
+	quotaMu sync.Mutex
+
+	// shutdownRequests : SIGINT and POST /admin/shutdown start the graceful shutdown
+	shutdownRequests = make(chan os.Signal, 1)
+
+	// ftpGroup : deduplicates concurrent retrievals of the same file
+	ftpGroup singleflight.Group
+)
+
+// Server : one configured instance of the service; handlers and middleware
+// are methods on it and read the settings through cfg()
+type Server struct {
+	// config : parsed by parseConfig, replaced as a whole on SIGHUP and never
+	// modified in place
+	config atomic.Pointer[Config]
+	// backend : archive selected by -backend
+	backend backend
+	// metrics : backend selected by -metrics
+	metrics Metrics
+	// s3 : -backend=s3 settings and client
+	s3 s3Struc
+
+	// pngEncoder : png output, compression set by -pngCompression
+	pngEncoder *png.Encoder
+	// copyBuffers : -copyBufferSize buffers of storeDocument
+	copyBuffers sync.Pool
+
+	// keyMap : partner key to internal key, reloaded on SIGHUP
+	keyMap struct {
+		sync.RWMutex
+		keys map[string]string
+	}
+
+	// recordings : last -recordSize sampled requests, see recording()
+	recordings struct {
+		sync.Mutex
+		entries []recordedRequest
+		next    int
+		seen    int64
+	}
+
+	// auditLog : -auditLog trail of served attestations, nil when disabled
+	auditLog *auditWriter
+
+	// barcodeCache : in-memory barcodes when -barcodeCacheBytes is set
+	barcodeCache *lruCache
+	// readOnlyDirectory : directory is unset or not writable, barcodes are
+	// returned in the response instead of written
+	readOnlyDirectory int32
+
+	// barcodeSlots : semaphore of the -barcodeWorkers encodings
+	barcodeSlots chan struct{}
+	// barcodeWaiting : requests holding or queued for a barcodeSlots slot
+	barcodeWaiting int64
+
+	// ftpSlots : semaphore bounding in-flight ftp retrievals
+	ftpSlots chan struct{}
+
+	// registry : prometheus metrics of -metrics=prometheus
+	registry *prometheus.Registry
+}
+
+// backend : document archive, ftp or s3
+type backend struct {
+	// retrieve : fetch filename into directory
+	retrieve func(ctx context.Context, directory string, filename string) (*os.File, error)
+	// stat : presence check of filename
+	stat func(ctx context.Context, filename string) error
+	// list : keys starting with prefix
+	list func(ctx context.Context, prefix string) ([]string, error)
+}
+
+// cfg : settings of the server; a request loads it once and keeps that
+// snapshot across a SIGHUP reload
+func (s *Server) cfg() *Config {
+	return s.config.Load()
+}
+
+const (
+	// tempFilePrefix : marks in-progress downloads so the sweep never touches real documents
+	tempFilePrefix = ".download-"
+	// fetchedSuffix : empty file next to a pdf fetched from the archive, its
+	// mtime is the fetch time while the pdf keeps the archive's mtime
+	fetchedSuffix = ".fetched"
+
+	maxPreviewWidth    = 2000
+	maxPreviewCache    = 256
+	maxRequestIDLength = 128
+	drainRetryAfter    = "5"
+	defaultCaptionSize = 14
+	minCaptionSize     = 6
+	maxCaptionSize     = 72
+	defaultBarcodeSize = 200
+	maxBarcodeSize     = 4000
+	quietZoneModules   = 10
+	minBarcodeDpi      = 72
+	maxBarcodeDpi      = 2400
+	notifyAttempts     = 5
+	maxBarcodeMargin   = 1000
+	minCopyBufferSize  = 4 << 10
+	maxCopyBufferSize  = 16 << 20
+	defaultListLimit   = 100
+	sourceLocal        = "local"
+	sourceEmbedded     = "embedded"
+	sourceStale        = "stale"
+	maxGalleryImages   = 50
+	minLookupPrefix    = 3
+	maxLookupMatches   = 20
+	maxMergeKeys       = 50
+	maxListLimit       = 1000
+	minSigningKeyBytes = 16
+)
+
+var (
+	pdfiumOnce sync.Once
+	pdfiumPool pdfium.Pool
+	pdfiumErr  error
+)
+
+var (
+	// errPdfTooLarge : remote pdf exceeds maxPdfBytes
+	errPdfTooLarge = errors.New("pdf exceeds maximum size")
+	// errDocumentNotFound : document is missing from the archive
+	errDocumentNotFound = errors.New("document not found")
+	// errBackend : archive failed to serve the document
+	errBackend = errors.New("archive backend error")
+	// errFtpTimeout : an ftp operation exceeded ftpOpTimeout
+	errFtpTimeout = errors.New("ftp operation timed out")
+	// errFtpDial : no connection to the ftp server
+	errFtpDial = fmt.Errorf("ftp dial failed: %w", errBackend)
+	// errFtpLogin : ftp server refused the credentials
+	errFtpLogin = fmt.Errorf("ftp login failed: %w", errBackend)
+	// errFtpNotFound : 550 on RETR, the file isn't on the server
+	errFtpNotFound = fmt.Errorf("ftp file not found: %w", errDocumentNotFound)
+	// errFtpRetrieve : RETR failed for another reason
+	errFtpRetrieve = fmt.Errorf("ftp retrieve failed: %w", errBackend)
+	// errFtpCopy : transfer broke while copying into directory
+	errFtpCopy = fmt.Errorf("ftp transfer failed: %w", errBackend)
+	// errFtpCorrupt : a .pdf.gz from the archive is truncated or corrupt
+	errFtpCorrupt = fmt.Errorf("corrupt compressed attestation: %w", errBackend)
+	// errQuotaExceeded : eviction can't bring directory under maxDirBytes
+	errQuotaExceeded = errors.New("directory quota exceeded")
+	// errBarcodeQueueFull : -barcodeQueue requests already wait for a worker
+	errBarcodeQueueFull = errors.New("barcode queue full")
 )
 
+type s3Struc struct {
+	endpoint  string
+	bucket    string
+	accessKey string
+	secretKey string
+	useSSL    bool
+	client    *minio.Client
+}
+
 type ftpStruc struct {
 	srvFtp  string
 	userFtp string
 	pwdFtp  string
+	dirFtp  string
 }
 
+// embeddedDocs : sample attestations served with -embedded
+//
+//go:embed samples/*.pdf
+var embeddedDocs embed.FS
+
+const embeddedDir = "samples"
+
 // ImageTemplate : Template loading Image
 var ImageTemplate string = `<!DOCTYPE html>
     <html lang="en"><head></head>
 	<body><img src="data:image/jpg;base64,{{.Image}}"></body>`
 
+// GalleryTemplate : ImageTemplate for every image of a key
+var GalleryTemplate string = `<!DOCTYPE html>
+    <html lang="en"><head></head>
+	<body>{{range .Images}}<img src="{{.Src}}" alt="{{.Name}}">{{end}}</body>`
+
+// ErrorTemplate : Template generic error
+var ErrorTemplate string = `<!DOCTYPE html>
+<html lang="en"><head></head>
+<body><p>%s</p></body>`
+
 // ImageNotFound : Template loading error
 var ImageNotFound string = `<!DOCTYPE html>
     <html lang="en"><head></head>
@@ -54,204 +314,4426 @@ var PdfNotFound string = `<!DOCTYPE html>
 <html lang="en"><head></head>
 <body><p>Impossible de lire l'attestation vétérinaire. Non Trouvé</p></body>`
 
+// PdfNotFoundEn : Template loading error (english)
+var PdfNotFoundEn string = `<!DOCTYPE html>
+<html lang="en"><head></head>
+<body><p>Unable to read the veterinary certificate. Not Found</p></body>`
+
+// ImageNotFoundEn : Template loading error (english)
+var ImageNotFoundEn string = `<!DOCTYPE html>
+    <html lang="en"><head></head>
+	<body><p>Unable to read the veterinary certificate. Not Found</p></body>`
+
+// defaultLanguage : used when Accept-Language offers nothing we support
+const defaultLanguage = "fr"
+
+// pdfNotFoundPages, imageNotFoundPages : error templates by language
+var (
+	pdfNotFoundPages = map[string]string{
+		"fr": PdfNotFound,
+		"en": PdfNotFoundEn,
+	}
+	imageNotFoundPages = map[string]string{
+		"fr": ImageNotFound,
+		"en": ImageNotFoundEn,
+	}
+)
+
+// envPrefix : environment variables read for flags missing from the command
+// line, e.g. VETSHEET_SRVFTP for -srvFtp or VETSHEET_LISTEN_ADDR for -listen-addr
+const envPrefix = "VETSHEET_"
+
+// Config : server settings parsed once by parseConfig, flag names unchanged
+type Config struct {
+	listenAddr              string
+	directory               string
+	tempDir                 string
+	ftp                     ftpStruc
+	secrets                 secretFiles
+	backend                 string
+	s3                      s3Struc
+	baseURL                 string
+	maxPdfBytes             int64
+	accessLogFormat         string
+	ftpOpTimeout            time.Duration
+	ftpDialTimeout          time.Duration
+	ftpDataTimeout          time.Duration
+	ftpDisableEPSV          bool
+	ftpMode                 string
+	ftpCharset              string
+	ftpEncoding             encoding.Encoding
+	ftpNameTemplate         string
+	ftpNameTmpl             *texttemplate.Template
+	ftpWarmup               bool
+	copyBufferSize          int
+	barcodeWorkers          int
+	barcodeCacheControl     string
+	attestationCacheControl string
+	barcodeQueue            int
+	maxBodyBytes            int64
+	maxUploadBytes          int64
+	localRetries            int
+	localRetryDelay         time.Duration
+	ftpWarmupTimeout        time.Duration
+	ftpWarmupRequired       bool
+	ftpCooldown             time.Duration
+	ftpPoolSize             int
+	ftpKeepAlive            time.Duration
+	maxFtpFetches           int
+	debug                   bool
+	pprofEnabled            bool
+	pprofAddr               string
+	embeddedMode            bool
+	indexBody               string
+	healthzUpBody           string
+	healthzDownBody         string
+	healthzContentType      string
+	healthzUp               *texttemplate.Template
+	healthzDown             *texttemplate.Template
+	h2cEnabled              bool
+	maxConns                int
+	shutdownTimeout         time.Duration
+	cacheTTL                time.Duration
+	serveStale              bool
+	barcodeCacheBytes       int64
+	basePath                string
+	basePathHealthz         bool
+	requestTimeout          time.Duration
+	timeoutMessage          string
+	pngCompression          png.CompressionLevel
+	barcodeDpi              int
+	maxDirBytes             int64
+	notifyURL               string
+	configFile              string
+	keyMapFile              string
+	metricsBackend          string
+	checkOnly               bool
+	apiKey                  string
+	enableAdmin             bool
+	adminAllowFrom          []*net.IPNet
+	maxGoroutines           int
+	maxOpenFiles            int
+	monitorInterval         time.Duration
+	documentExtensions      []string
+	watermark               string
+	auditLogDest            string
+	logFile                 string
+	recordRate              float64
+	recordSize              int
+	logMaxSize              int
+	logMaxAge               int
+	logMaxBackups           int
+	logCompress             bool
+	signingKey              string
+	signedURLTTL            time.Duration
+	signedURLMaxTTL         time.Duration
+	watermarkStyle          string
+	documentTypes           map[string]string
+	hstsHeader              string
+	logSkipPaths            map[string]bool
+	responseHeaders         map[string]string
+	trustedProxies          []*net.IPNet
+	proxyProtocolFrom       []*net.IPNet
+
+	// fetch subcommand
+	fetchMode   bool
+	fetchKeys   string
+	fetchPrefix string
+}
+
+// parseConfig : settings from args, then from envPrefix variables for the
+// flags args leave out; "fetch" as first argument selects the subcommand
+func parseConfig(args []string) (*Config, error) {
+	cfg := &Config{
+		logSkipPaths: make(map[string]bool),
+		documentTypes: map[string]string{
+			".pdf":  "application/pdf",
+			".tif":  "image/tiff",
+			".tiff": "image/tiff",
+			".p7m":  "application/pkcs7-mime",
+		},
+		responseHeaders: map[string]string{
+			"X-Content-Type-Options":  "nosniff",
+			"X-Frame-Options":         "SAMEORIGIN",
+			"Content-Security-Policy": "default-src 'self'; img-src 'self' data:; frame-ancestors 'self'",
+			"Referrer-Policy":         "no-referrer",
+		},
+	}
+
+	// "server fetch -key ABC123 [flags]" retrieves from the archive and exits
+	if len(args) > 0 && args[0] == "fetch" {
+		cfg.fetchMode = true
+		args = args[1:]
+	}
+
+	fs := flag.NewFlagSet(serviceName, flag.ContinueOnError)
+	fs.StringVar(&cfg.listenAddr, "listen-addr", ":5000", "server listen address (host:port or unix:/path/to.sock)")
+	fs.StringVar(&cfg.directory, "directory", ".", "directory location document")
+	fs.StringVar(&cfg.tempDir, "tempDir", "", "directory of in-progress downloads (default: -directory)")
+	fs.StringVar(&cfg.ftp.srvFtp, "srvFtp", "localhost", "Ftp servername archive, host or host:port (comma-separated list for failover)")
+	fs.StringVar(&cfg.ftp.userFtp, "userFtp", "userftp", "Ftp username archive")
+	fs.StringVar(&cfg.ftp.pwdFtp, "pwdFtp", "pwd", "Ftp password archive")
+	fs.StringVar(&cfg.secrets.srvFtp, "srvFtpFile", "", "file holding the Ftp servername archive (overrides -srvFtp)")
+	fs.StringVar(&cfg.secrets.userFtp, "userFtpFile", "", "file holding the Ftp username archive (overrides -userFtp)")
+	fs.StringVar(&cfg.secrets.pwdFtp, "pwdFtpFile", "", "file holding the Ftp password archive (overrides -pwdFtp)")
+	fs.StringVar(&cfg.ftp.dirFtp, "ftpDir", "", "Ftp remote directory archive")
+	fs.StringVar(&cfg.backend, "backend", "ftp", "archive backend (ftp, s3)")
+	fs.StringVar(&cfg.s3.endpoint, "s3Endpoint", "localhost:9000", "S3 endpoint archive")
+	fs.StringVar(&cfg.s3.bucket, "s3Bucket", "attestations", "S3 bucket archive")
+	fs.StringVar(&cfg.s3.accessKey, "s3AccessKey", "", "S3 access key archive")
+	fs.StringVar(&cfg.s3.secretKey, "s3SecretKey", "", "S3 secret key archive")
+	fs.BoolVar(&cfg.s3.useSSL, "s3SSL", true, "use https to reach the S3 endpoint")
+	fs.StringVar(&cfg.baseURL, "baseURL", "http://localhost:5000", "public base url used to build attestation links")
+	fs.Int64Var(&cfg.maxBodyBytes, "maxBodyBytes", 4<<10, "maximum request body size in bytes of the endpoints without uploads")
+	fs.Int64Var(&cfg.maxUploadBytes, "maxUploadBytes", 10<<20, "maximum request body size in bytes of /barcode/decode")
+	fs.Int64Var(&cfg.maxPdfBytes, "maxPdfBytes", 50<<20, "maximum size in bytes of a pdf downloaded from ftp (0 = unlimited)")
+	fs.StringVar(&cfg.accessLogFormat, "accessLogFormat", "default", "access log format (default, common, combined)")
+	fs.DurationVar(&cfg.ftpOpTimeout, "ftpOpTimeout", 30*time.Second, "timeout of each ftp operation (0 = none)")
+	fs.DurationVar(&cfg.ftpDialTimeout, "ftpDialTimeout", 5*time.Second, "timeout of the ftp control and data connection dials")
+	fs.DurationVar(&cfg.ftpDataTimeout, "ftpDataTimeout", 0, "timeout of each read or write on ftp data connections (0 = -ftpOpTimeout)")
+	fs.BoolVar(&cfg.ftpDisableEPSV, "ftpDisableEPSV", false, "use PASV instead of EPSV for ftp data connections")
+	fs.StringVar(&cfg.ftpCharset, "ftpCharset", "utf-8", "charset of the ftp server file names, e.g. latin1")
+	fs.StringVar(&cfg.ftpNameTemplate, "ftpNameTemplate", "", "name of the attestations on the ftp archive, e.g. ATT_{{.Key}}_v2{{.Ext}} (empty = <key>.pdf)")
+	fs.StringVar(&cfg.ftpMode, "ftpMode", "passive", "ftp data connection mode, only passive is supported")
+	fs.BoolVar(&cfg.ftpWarmup, "ftpWarmup", false, "open -ftpPoolSize connections to every ftp server before reporting ready")
+	fs.DurationVar(&cfg.ftpWarmupTimeout, "ftpWarmupTimeout", 30*time.Second, "time given to -ftpWarmup")
+	fs.BoolVar(&cfg.ftpWarmupRequired, "ftpWarmupRequired", false, "exit when -ftpWarmup can't reach any ftp server instead of starting degraded")
+	fs.IntVar(&cfg.copyBufferSize, "copyBufferSize", 32<<10, "buffer size in bytes of archive downloads, larger helps on high-latency links")
+	fs.DurationVar(&cfg.ftpCooldown, "ftpCooldown", 30*time.Second, "time a failing ftp server is skipped")
+	fs.IntVar(&cfg.ftpPoolSize, "ftpPoolSize", 2, "idle ftp connections kept per server (0 = no pooling)")
+	fs.DurationVar(&cfg.ftpKeepAlive, "ftpKeepAlive", 30*time.Second, "interval of NOOP on idle ftp connections (0 = disabled)")
+	fs.IntVar(&cfg.maxFtpFetches, "maxFtpFetches", 4, "maximum number of simultaneous ftp retrievals (0 = unlimited)")
+	fs.BoolVar(&cfg.debug, "debug", false, "enable debug logging")
+	fs.BoolVar(&cfg.pprofEnabled, "pprof", false, "serve /debug/pprof on -pprofAddr")
+	fs.StringVar(&cfg.pprofAddr, "pprofAddr", "localhost:6060", "pprof listen address, keep it private")
+	fs.BoolVar(&cfg.embeddedMode, "embedded", false, "serve the sample attestations embedded in the binary before falling back to the archive")
+	fs.StringVar(&cfg.indexBody, "indexBody", "", "plain text body served on / (default: json status)")
+	fs.StringVar(&cfg.healthzUpBody, "healthzUpBody", "UP", "body of /healthz when healthy, text/template with .Status, .Version and .Uptime")
+	fs.StringVar(&cfg.healthzDownBody, "healthzDownBody", "DOWN", "body of /healthz when unhealthy (503), same fields as -healthzUpBody")
+	fs.StringVar(&cfg.healthzContentType, "healthzContentType", "text/plain", "content type of the /healthz bodies")
+	fs.BoolVar(&cfg.h2cEnabled, "h2c", false, "accept HTTP/2 cleartext (h2c) connections")
+	fs.IntVar(&cfg.maxConns, "maxConns", 0, "maximum number of simultaneous connections (0 = unlimited)")
+	fs.DurationVar(&cfg.shutdownTimeout, "shutdownTimeout", 30*time.Second, "time given to in-flight requests on shutdown")
+	fs.IntVar(&cfg.localRetries, "localRetries", 0, "extra looks for a missing local document before asking the archive, for shared NFS volumes")
+	fs.DurationVar(&cfg.localRetryDelay, "localRetryDelay", 100*time.Millisecond, "delay between -localRetries")
+	fs.DurationVar(&cfg.cacheTTL, "cacheTTL", 0, "age after which a local pdf is fetched again from the archive (0 = never)")
+	fs.BoolVar(&cfg.serveStale, "serveStale", false, "serve an expired local pdf when the archive is unreachable")
+	fs.Int64Var(&cfg.barcodeCacheBytes, "barcodeCacheBytes", 0, "serve generated barcodes from an in-memory LRU cache of this many bytes instead of the directory (0 = disabled)")
+	fs.StringVar(&cfg.basePath, "basePath", "", "path prefix of every route, e.g. /vet")
+	fs.BoolVar(&cfg.basePathHealthz, "basePathHealthz", false, "serve /healthz under -basePath only instead of at the root")
+	fs.DurationVar(&cfg.requestTimeout, "requestTimeout", 0, "time after which a request is answered 503 and its ftp fetch cancelled (0 = none)")
+	fs.StringVar(&cfg.timeoutMessage, "timeoutMessage", fmt.Sprintf(ErrorTemplate, "Service Unavailable: request timed out"), "body of the 503 sent past -requestTimeout")
+	pngCompression := fs.String("pngCompression", "default", "png compression level (default, speed, best, none)")
+	fs.StringVar(&cfg.barcodeCacheControl, "barcodeCacheControl", "public, max-age=86400", "Cache-Control of barcodes and qrcodes (empty = none)")
+	fs.StringVar(&cfg.attestationCacheControl, "attestationCacheControl", "private, max-age=300", "Cache-Control of attestations (empty = none)")
+	fs.IntVar(&cfg.barcodeWorkers, "barcodeWorkers", runtime.GOMAXPROCS(0), "barcodes encoded at the same time")
+	fs.IntVar(&cfg.barcodeQueue, "barcodeQueue", 64, "barcode requests waiting for a worker before answering 503")
+	fs.IntVar(&cfg.barcodeDpi, "barcodeDpi", 300, "default dpi of barcodes requested with a physical size")
+	fs.Int64Var(&cfg.maxDirBytes, "maxDirBytes", 0, "maximum size in bytes of directory, oldest files are evicted to make room (0 = unlimited)")
+	fs.StringVar(&cfg.notifyURL, "notifyURL", "", "url POSTed a json notification when a barcode is generated (empty = disabled)")
+	fs.StringVar(&cfg.configFile, "configFile", "", "json file overriding directory, srvFtp, userFtp, pwdFtp, ftpDir and debug, reloaded on SIGHUP")
+	fs.StringVar(&cfg.keyMapFile, "keyMapFile", "", "csv file mapping partner keys to attestation keys (?keyType=partner)")
+	fs.StringVar(&cfg.metricsBackend, "metrics", "none", "metrics backend (none, prometheus)")
+	fs.BoolVar(&cfg.checkOnly, "check", false, "validate configuration and connectivity, then exit")
+	fs.StringVar(&cfg.apiKey, "apiKey", "", "api key required in X-API-Key by protected endpoints (empty = disabled)")
+	fs.IntVar(&cfg.maxGoroutines, "maxGoroutines", 0, "goroutine count past which /healthz reports DOWN (0 = unchecked)")
+	fs.IntVar(&cfg.maxOpenFiles, "maxOpenFiles", 0, "open file descriptor count past which /healthz reports DOWN, linux only (0 = unchecked)")
+	fs.DurationVar(&cfg.monitorInterval, "monitorInterval", 30*time.Second, "sampling interval of -maxGoroutines and -maxOpenFiles")
+	fs.StringVar(&cfg.signingKey, "signingKey", "", "secret of the signed attestation urls of /attestation/sign (empty = disabled)")
+	fs.DurationVar(&cfg.signedURLTTL, "signedURLTTL", time.Hour, "validity of a signed url when /attestation/sign gets no ttl")
+	fs.DurationVar(&cfg.signedURLMaxTTL, "signedURLMaxTTL", 7*24*time.Hour, "longest ttl accepted by /attestation/sign")
+	fs.BoolVar(&cfg.enableAdmin, "enableAdmin", false, "serve the /admin endpoints, requires -apiKey")
+	fs.Float64Var(&cfg.recordRate, "recordRate", 0, "fraction of requests recorded for GET /admin/recordings, 0 to 1 (0 = disabled)")
+	fs.IntVar(&cfg.recordSize, "recordSize", 100, "recordings kept, oldest dropped first")
+	fs.StringVar(&cfg.logFile, "logFile", "", "log to this file, rotated, instead of stdout")
+	fs.IntVar(&cfg.logMaxSize, "logMaxSize", 100, "size in megabytes of -logFile before rotation")
+	fs.IntVar(&cfg.logMaxAge, "logMaxAge", 28, "days rotated -logFile backups are kept (0 = forever)")
+	fs.IntVar(&cfg.logMaxBackups, "logMaxBackups", 5, "rotated -logFile backups kept (0 = all)")
+	fs.BoolVar(&cfg.logCompress, "logCompress", false, "gzip rotated -logFile backups")
+	fs.StringVar(&cfg.auditLogDest, "auditLog", "", "audit trail of served attestations: file path, syslog (local) or syslog://host:514 (empty = disabled)")
+	fs.StringVar(&cfg.watermark, "watermark", "", "text stamped on every page of served attestations with the delivery time, e.g. COPY (empty = disabled)")
+	fs.StringVar(&cfg.watermarkStyle, "watermarkStyle", "font:Helvetica, points:36, rot:45, opacity:0.3, fillc:#808080", "pdfcpu description of the -watermark stamp")
+	extensions := fs.String("documentExtensions", ".pdf", "comma-separated extensions tried in order for /attestation, e.g. .pdf,.tif,.p7m")
+	fs.Func("documentType", `content type of an extension ".ext=type/subtype", repeatable`, func(v string) error {
+		ext, contentType, ok := strings.Cut(v, "=")
+		ext, contentType = strings.ToLower(strings.TrimSpace(ext)), strings.TrimSpace(contentType)
+		if !ok || !strings.HasPrefix(ext, ".") || contentType == "" {
+			return fmt.Errorf("expected \".ext=type/subtype\"")
+		}
+		if _, _, err := mime.ParseMediaType(contentType); err != nil {
+			return err
+		}
+		cfg.documentTypes[ext] = contentType
+		return nil
+	})
+	adminAllow := fs.String("adminAllowFrom", "127.0.0.0/8,::1/128", "comma-separated CIDRs allowed to call the /admin endpoints, matched against the client address seen through -trustedProxies")
+	skipPaths := fs.String("logSkipPaths", "/healthz,/readyz,/favicon.ico", "comma-separated paths excluded from the access log")
+	fs.Func("header", `response header "Name: value" added to every response, repeatable; "Name:" removes a default`, func(v string) error {
+		name, value, ok := strings.Cut(v, ":")
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		if !ok || name == "" {
+			return fmt.Errorf("expected \"Name: value\"")
+		}
+		if name == "Content-Type" {
+			return fmt.Errorf("Content-Type is set by the handlers")
+		}
+		if value = strings.TrimSpace(value); value == "" {
+			delete(cfg.responseHeaders, name)
+		} else {
+			cfg.responseHeaders[name] = value
+		}
+		return nil
+	})
+	fs.StringVar(&cfg.hstsHeader, "hsts", "max-age=31536000", "Strict-Transport-Security of https requests (empty = disabled)")
+	proxies := fs.String("trustedProxies", "", "comma-separated CIDRs of proxies trusted for X-Forwarded-For")
+	proxyProtocol := fs.String("proxyProtocolFrom", "", "comma-separated CIDRs of load balancers sending a PROXY protocol header (empty = disabled)")
+	fs.StringVar(&cfg.fetchKeys, "key", "", "fetch subcommand: comma-separated attestation keys to retrieve")
+	fs.StringVar(&cfg.fetchPrefix, "prefix", "", "fetch subcommand: warm directory with every archived attestation starting with prefix")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// the command line wins over the environment
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	var envErr error
+	fs.VisitAll(func(f *flag.Flag) {
+		name := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		value, ok := os.LookupEnv(name)
+		if !ok || given[f.Name] || envErr != nil {
+			return
+		}
+		if err := fs.Set(f.Name, value); err != nil {
+			envErr = fmt.Errorf("invalid %s: %v", name, err)
+		}
+	})
+	if envErr != nil {
+		return nil, envErr
+	}
+
+	for _, p := range strings.Split(*skipPaths, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			cfg.logSkipPaths[p] = true
+		}
+	}
+
+	for _, ext := range strings.Split(*extensions, ",") {
+		if ext = strings.ToLower(strings.TrimSpace(ext)); ext == "" {
+			continue
+		}
+		if !strings.HasPrefix(ext, ".") || strings.ContainsAny(ext, "/\\") {
+			return nil, fmt.Errorf("invalid document extension: %s", ext)
+		}
+		cfg.documentExtensions = append(cfg.documentExtensions, ext)
+	}
+	if len(cfg.documentExtensions) == 0 {
+		return nil, fmt.Errorf("documentExtensions is empty")
+	}
+
+	var err error
+	if cfg.trustedProxies, err = parseCIDRs(*proxies); err != nil {
+		return nil, fmt.Errorf("invalid trusted proxy: %v", err)
+	}
+	if cfg.proxyProtocolFrom, err = parseCIDRs(*proxyProtocol); err != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol upstream: %v", err)
+	}
+	if cfg.adminAllowFrom, err = parseCIDRs(*adminAllow); err != nil {
+		return nil, fmt.Errorf("invalid admin network: %v", err)
+	}
+
+	// utf-8 names are sent as is
+	if charset := strings.ToLower(cfg.ftpCharset); charset != "utf-8" && charset != "utf8" {
+		if cfg.ftpEncoding, err = htmlindex.Get(charset); err != nil {
+			return nil, fmt.Errorf("unknown ftp charset %s: %v", cfg.ftpCharset, err)
+		}
+	}
+	if cfg.healthzUp, err = parseHealthzBody(cfg.healthzUpBody); err != nil {
+		return nil, fmt.Errorf("invalid healthzUpBody: %v", err)
+	}
+	if cfg.healthzDown, err = parseHealthzBody(cfg.healthzDownBody); err != nil {
+		return nil, fmt.Errorf("invalid healthzDownBody: %v", err)
+	}
+	if _, _, err := mime.ParseMediaType(cfg.healthzContentType); err != nil {
+		return nil, fmt.Errorf("invalid healthzContentType %s: %v", cfg.healthzContentType, err)
+	}
+	if cfg.ftpNameTemplate != "" {
+		if cfg.ftpNameTmpl, err = parseFtpNameTemplate(cfg.ftpNameTemplate); err != nil {
+			return nil, fmt.Errorf("invalid ftp name template %s: %v", cfg.ftpNameTemplate, err)
+		}
+	}
+
+	pngLevels := map[string]png.CompressionLevel{
+		"default": png.DefaultCompression,
+		"speed":   png.BestSpeed,
+		"best":    png.BestCompression,
+		"none":    png.NoCompression,
+	}
+	level, ok := pngLevels[*pngCompression]
+	if !ok {
+		return nil, fmt.Errorf("unknown png compression: %s", *pngCompression)
+	}
+	cfg.pngCompression = level
+
+	if cfg.basePath = strings.TrimRight(cfg.basePath, "/"); cfg.basePath != "" && !strings.HasPrefix(cfg.basePath, "/") {
+		cfg.basePath = "/" + cfg.basePath
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// validate : values parseConfig can't check while parsing
+func (cfg *Config) validate() error {
+	if err := validateListenAddr(cfg.listenAddr); err != nil {
+		return fmt.Errorf("invalid listen address %q: %v", cfg.listenAddr, err)
+	}
+	if cfg.barcodeDpi < minBarcodeDpi || cfg.barcodeDpi > maxBarcodeDpi {
+		return fmt.Errorf("invalid barcodeDpi %d, must be between %d and %d", cfg.barcodeDpi, minBarcodeDpi, maxBarcodeDpi)
+	}
+	if (cfg.maxGoroutines > 0 || cfg.maxOpenFiles > 0) && cfg.monitorInterval <= 0 {
+		return fmt.Errorf("monitorInterval must be positive")
+	}
+	if cfg.recordRate < 0 || cfg.recordRate > 1 || cfg.recordSize < 1 {
+		return fmt.Errorf("recordRate must be between 0 and 1 and recordSize positive")
+	}
+	if cfg.logFile != "" && (cfg.logMaxSize <= 0 || cfg.logMaxAge < 0 || cfg.logMaxBackups < 0) {
+		return fmt.Errorf("logMaxSize must be positive, logMaxAge and logMaxBackups not negative")
+	}
+	if cfg.watermark != "" {
+		if _, err := api.TextWatermark(cfg.watermark, cfg.watermarkStyle, true, false, types.POINTS); err != nil {
+			return fmt.Errorf("invalid watermarkStyle: %v", err)
+		}
+	}
+	if cfg.enableAdmin && cfg.apiKey == "" {
+		return fmt.Errorf("enableAdmin requires apiKey")
+	}
+	if cfg.signingKey != "" && len(cfg.signingKey) < minSigningKeyBytes {
+		return fmt.Errorf("signingKey must be at least %d bytes", minSigningKeyBytes)
+	}
+	if cfg.signedURLTTL <= 0 || cfg.signedURLMaxTTL < cfg.signedURLTTL {
+		return fmt.Errorf("signedURLTTL must be positive and not above signedURLMaxTTL")
+	}
+	switch cfg.accessLogFormat {
+	case "default", "common", "combined":
+	default:
+		return fmt.Errorf("unknown access log format: %s", cfg.accessLogFormat)
+	}
+	switch cfg.ftpMode {
+	case "passive":
+	case "active":
+		return fmt.Errorf("active ftp mode isn't supported by the ftp client, use passive with -ftpDisableEPSV behind NAT")
+	default:
+		return fmt.Errorf("unknown ftp mode: %s", cfg.ftpMode)
+	}
+	if cfg.localRetries < 0 || (cfg.localRetries > 0 && cfg.localRetryDelay <= 0) {
+		return fmt.Errorf("localRetries needs a positive localRetryDelay")
+	}
+	if cfg.maxBodyBytes < 0 || cfg.maxUploadBytes <= 0 {
+		return fmt.Errorf("maxBodyBytes and maxUploadBytes must be positive")
+	}
+	if cfg.barcodeWorkers < 1 || cfg.barcodeQueue < 0 {
+		return fmt.Errorf("barcodeWorkers must be positive and barcodeQueue not negative")
+	}
+	if cfg.copyBufferSize < minCopyBufferSize || cfg.copyBufferSize > maxCopyBufferSize {
+		return fmt.Errorf("invalid copyBufferSize %d, must be between %d and %d", cfg.copyBufferSize, minCopyBufferSize, maxCopyBufferSize)
+	}
+	if cfg.ftpDialTimeout <= 0 {
+		return fmt.Errorf("ftpDialTimeout must be positive")
+	}
+	switch cfg.backend {
+	case "ftp", "s3":
+	default:
+		return fmt.Errorf("unknown backend: %s", cfg.backend)
+	}
+	switch cfg.metricsBackend {
+	case "none", "prometheus":
+	default:
+		return fmt.Errorf("unknown metrics backend: %s", cfg.metricsBackend)
+	}
+	return nil
+}
+
+// parseCIDRs : comma-separated CIDR list
+func parseCIDRs(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range strings.Split(list, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
 func main() {
-	flag.StringVar(&listenAddr, "listen-addr", ":5000", "server listen address")
-	flag.StringVar(&directory, "directory", ".", "directory location document")
-	flag.StringVar(&ftpClient.srvFtp, "srvFtp", "localhost", "Ftp servername archive")
-	flag.StringVar(&ftpClient.userFtp, "userFtp", "userftp", "Ftp username archive")
-	flag.StringVar(&ftpClient.pwdFtp, "pwdFtp", "pwd", "Ftp password archive")
-	flag.Parse()
+	cfg, err := parseConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 
 	logger = log.New(os.Stdout, "http: ", log.LstdFlags)
+	if cfg.fetchMode {
+		// stdout only carries the fetched paths
+		logger.SetOutput(os.Stderr)
+	}
+	if cfg.logFile != "" {
+		logFile := &lumberjack.Logger{
+			Filename:   cfg.logFile,
+			MaxSize:    cfg.logMaxSize,
+			MaxAge:     cfg.logMaxAge,
+			MaxBackups: cfg.logMaxBackups,
+			Compress:   cfg.logCompress,
+		}
+		defer logFile.Close()
+		logger.SetOutput(logFile)
+	}
 	logger.Println("Server is starting...")
 
-	router := http.NewServeMux()
-	router.Handle("/", index())
-	router.Handle("/healthz", healthz())
-	//router.Handle("/attestation", attestation())
-	router.Handle("/attestation", attestationPdf())
-	router.Handle("/sampleIdToBarCode", generateBarCode())
+	// flags are the base, -configFile then the secret files override them,
+	// the same way on every SIGHUP
+	flagSettings := settings{directory: cfg.directory, ftp: cfg.ftp, debug: cfg.debug}
+	current, err := loadSettings(cfg.configFile, flagSettings, cfg.secrets)
+	if err != nil {
+		logger.Fatalf("Could not load configuration: %v\n", err)
+	}
+	srv, err := newServer(cfg)
+	if err != nil {
+		logger.Fatalf("Could not create server: %v\n", err)
+	}
+	srv.applySettings(current)
 
-	nextRequestID := func() string {
-		return fmt.Sprintf("%d", time.Now().UnixNano())
+	if cfg.keyMapFile != "" {
+		if err := srv.loadKeyMap(cfg.keyMapFile); err != nil {
+			logger.Fatalf("Could not load key map %s: %v\n", cfg.keyMapFile, err)
+		}
 	}
 
-	server := &http.Server{
-		Addr:         listenAddr,
-		Handler:      tracing(nextRequestID)(logging()(router)),
-		ErrorLog:     logger,
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
-		IdleTimeout:  15 * time.Second,
+	if cfg.auditLogDest != "" && !cfg.fetchMode && !cfg.checkOnly {
+		srv.auditLog, err = openAuditLog(cfg.auditLogDest)
+		if err != nil {
+			logger.Fatalf("Could not open audit log %s: %v\n", cfg.auditLogDest, err)
+		}
+	}
+
+	if cfg.checkOnly {
+		if !srv.runChecks() {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	directory := srv.cfg().directory
+	err = fmt.Errorf("unset")
+	if directory != "" {
+		err = checkDirectory(directory)
+	}
+	switch {
+	case err == nil:
+		if err := checkDirectory(srv.tempDirectory()); err != nil {
+			logger.Fatalf("Temp directory %s is not usable: %v\n", srv.tempDirectory(), err)
+		}
+		sweepTempFiles(directory)
+		if srv.tempDirectory() != directory {
+			sweepTempFiles(srv.tempDirectory())
+		}
+	case directory == "" || isReadOnly(err):
+		// stateless deployments: barcodes still work, archive documents
+		// can't be cached
+		logger.Printf("Directory %q is %v, barcodes are returned without being written\n", directory, err)
+		atomic.StoreInt32(&srv.readOnlyDirectory, 1)
+	default:
+		logger.Fatalf("Directory %s is not usable: %v\n", directory, err)
 	}
 
+	if cfg.fetchMode {
+		if !srv.runFetch(cfg.fetchKeys, cfg.fetchPrefix) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if cfg.ftpWarmup && cfg.backend == "ftp" {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.ftpWarmupTimeout)
+		opened, err := srv.warmupFtp(ctx, max(cfg.ftpPoolSize, 1))
+		cancel()
+		switch {
+		case opened > 0:
+			logger.Printf("ftp warmup opened %d connections\n", opened)
+		case cfg.ftpWarmupRequired:
+			logger.Fatalf("ftp warmup failed: %v\n", err)
+		default:
+			logger.Println("ftp warmup failed, starting without pooled connections", err)
+		}
+	}
+
+	if cfg.ftpPoolSize > 0 && cfg.ftpKeepAlive > 0 {
+		go srv.keepFtpAlive(cfg.ftpKeepAlive)
+	}
+
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		logger.Fatalf("Could not set up tracing: %v\n", err)
+	}
+
+	if cfg.pprofEnabled {
+		go servePprof(cfg.pprofAddr)
+	}
+
+	server := srv.httpServer()
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			next, err := loadSettings(cfg.configFile, flagSettings, cfg.secrets)
+			if err == nil {
+				err = checkDirectory(next.directory)
+			}
+			if err != nil {
+				logger.Println("Could not reload configuration, keeping the previous one", err)
+			} else {
+				srv.applySettings(next)
+				logger.Println("Configuration reloaded")
+			}
+
+			if cfg.keyMapFile == "" {
+				continue
+			}
+			if err := srv.loadKeyMap(cfg.keyMapFile); err != nil {
+				logger.Println("Could not reload key map, keeping the previous one", err)
+				continue
+			}
+			logger.Println("Key map reloaded from", cfg.keyMapFile)
+		}
+	}()
+
 	done := make(chan bool)
-	quit := make(chan os.Signal, 1)
+	quit := shutdownRequests
 	signal.Notify(quit, os.Interrupt)
 
 	go func() {
 		<-quit
 		logger.Println("Server is shutting down...")
 		atomic.StoreInt32(&healthy, 0)
+		atomic.StoreInt32(&shuttingDown, 1)
 
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.shutdownTimeout)
 		defer cancel()
 
 		server.SetKeepAlivesEnabled(false)
 		if err := server.Shutdown(ctx); err != nil {
-			logger.Fatalf("Could not gracefully shutdown the server: %v\n", err)
+			logger.Printf("Could not gracefully shutdown the server: %v, forcibly closing %d in-flight requests\n",
+				err, atomic.LoadInt64(&stats.inFlight))
+			server.Close()
+		}
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Println("Could not flush traces", err)
 		}
 		close(done)
 	}()
 
-	logger.Println("Server is ready to handle requests at", listenAddr)
+	listener, err := listen(cfg.listenAddr)
+	if err != nil {
+		logger.Fatalf("Could not listen on %s: %v\n", cfg.listenAddr, err)
+	}
+	if len(cfg.proxyProtocolFrom) > 0 {
+		// RemoteAddr becomes the client announced by the load balancer
+		listener = &proxyproto.Listener{
+			Listener:          listener,
+			Policy:            srv.proxyProtocolPolicy,
+			ReadHeaderTimeout: 5 * time.Second,
+		}
+	}
+	if cfg.maxConns > 0 {
+		// idle keep-alive connections hold a slot until IdleTimeout or
+		// Shutdown closes them
+		listener = netutil.LimitListener(listener, cfg.maxConns)
+	}
+
+	logger.Println("Server is ready to handle requests at", cfg.listenAddr)
 	atomic.StoreInt32(&healthy, 1)
-	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		logger.Fatalf("Could not listen on %s: %v\n", listenAddr, err)
+	if cfg.maxGoroutines > 0 || cfg.maxOpenFiles > 0 {
+		go srv.monitorResources(cfg.monitorInterval, cfg.maxGoroutines, cfg.maxOpenFiles)
+	}
+	if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+		logger.Fatalf("Could not listen on %s: %v\n", cfg.listenAddr, err)
 	}
 
 	<-done
+	if socketPath, ok := unixSocketPath(cfg.listenAddr); ok {
+		os.Remove(socketPath)
+	}
 	logger.Println("Server stopped")
 }
 
-func index() http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path != "/" {
-			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
-			return
-		}
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.Header().Set("X-Content-Type-Options", "nosniff")
-		w.WriteHeader(http.StatusOK)
-		fmt.Fprintln(w, "Hello, Folks!")
-	})
-}
+// newServer : server for cfg with its own backend, metrics and caches;
+// several can run in one process
+func newServer(cfg *Config) (*Server, error) {
+	s := &Server{
+		metrics:    noopMetrics{},
+		s3:         cfg.s3,
+		pngEncoder: &png.Encoder{CompressionLevel: cfg.pngCompression},
+		copyBuffers: sync.Pool{New: func() interface{} {
+			buf := make([]byte, cfg.copyBufferSize)
+			return &buf
+		}},
+		barcodeSlots: make(chan struct{}, cfg.barcodeWorkers),
+	}
+	s.config.Store(cfg)
 
-func healthz() http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if atomic.LoadInt32(&healthy) == 1 {
-			w.WriteHeader(http.StatusOK)
-			fmt.Fprintln(w, "UP")
-			return
+	switch cfg.backend {
+	case "s3":
+		client, err := minio.New(s.s3.endpoint, &minio.Options{
+			Creds:  credentials.NewStaticV4(s.s3.accessKey, s.s3.secretKey, ""),
+			Secure: s.s3.useSSL,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("S3 client: %w", err)
 		}
-		w.WriteHeader(http.StatusServiceUnavailable)
-	})
+		s.s3.client = client
+		s.backend = backend{retrieve: s.retrieveFromS3, stat: s.statOnS3, list: s.listOnS3}
+	default:
+		s.backend = backend{retrieve: s.retrieveFromSRVDATA, stat: s.statOnSRVDATA, list: s.listOnSRVDATA}
+	}
+
+	if cfg.metricsBackend == "prometheus" {
+		// a registry per server, the default one would refuse a second
+		// registration of the same metrics
+		s.registry = prometheus.NewRegistry()
+		s.registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+		s.metrics = newPrometheusMetrics(s.registry)
+	}
+	if cfg.maxFtpFetches > 0 {
+		s.ftpSlots = make(chan struct{}, cfg.maxFtpFetches)
+	}
+	if cfg.barcodeCacheBytes > 0 {
+		s.barcodeCache = newLRUCache(cfg.barcodeCacheBytes)
+	}
+	s.recordings.entries = make([]recordedRequest, 0, cfg.recordSize)
+
+	return s, nil
 }
 
-func generateBarCode() http.Handler {
+// httpServer : routes and middleware of s
+func (s *Server) httpServer() *http.Server {
+	cfg := s.cfg()
 
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	router := http.NewServeMux()
+	router.Handle("/", allowMethods(s.index(), http.MethodGet))
+	router.Handle("/healthz", allowMethods(s.healthz(), http.MethodGet))
+	router.Handle("/status", allowMethods(s.status(), http.MethodGet))
+	router.Handle("/favicon.ico", allowMethods(favicon(), http.MethodGet))
 
-		logger.Println("generateBarCode")
+	if s.registry != nil {
+		router.Handle("/metrics", allowMethods(promhttp.InstrumentMetricHandler(s.registry, promhttp.HandlerFor(s.registry, promhttp.HandlerOpts{})), http.MethodGet))
+	}
+	//router.Handle("/attestation", attestation())
+	router.Handle("/attestation", allowMethods(s.attestationPdf(), http.MethodGet))
+	router.Handle("/attestation/exists", allowMethods(s.existsPdf(), http.MethodGet))
+	router.Handle("/attestation/merge", allowMethods(s.mergePdf(), http.MethodGet))
+	router.Handle("/attestation/bundle", allowMethods(s.bundleAttestation(), http.MethodGet))
+	router.Handle("/attestation/lookup", allowMethods(s.requireAPIKey(s.lookupAttestation()), http.MethodGet))
+	router.Handle("/attestation/images", allowMethods(s.imageGallery(), http.MethodGet))
+	router.Handle("/attestation/preview", allowMethods(s.previewPdf(), http.MethodGet))
+	router.Handle("/attestations", allowMethods(s.requireAPIKey(s.listAttestations()), http.MethodGet))
+	if cfg.signingKey != "" {
+		router.Handle("/attestation/sign", allowMethods(s.requireAPIKey(s.signAttestation()), http.MethodGet))
+	}
+	router.Handle("/sampleIdToBarCode", allowMethods(s.generateBarCode(), http.MethodGet))
+	router.Handle("/sampleIdToQrCode", allowMethods(s.generateQrCode(), http.MethodGet))
+	router.Handle("/barcode/decode", allowMethods(decodeBarCode(), http.MethodPost))
+	if cfg.enableAdmin {
+		router.Handle("/admin/cache/clear", allowMethods(s.requireAdmin(s.clearCache()), http.MethodPost))
+		router.Handle("/admin/ftp/list", allowMethods(s.requireAdmin(s.listFtp()), http.MethodGet))
+		router.Handle("/admin/recordings", allowMethods(s.requireAdmin(s.listRecordings()), http.MethodGet))
+		router.Handle("/admin/shutdown", allowMethods(s.requireAdmin(s.shutdown()), http.MethodPost))
+	}
 
-		// get search key
-		keys, ok := r.URL.Query()["key"]
-		if !ok || len(keys[0]) < 1 {
-			w.WriteHeader(http.StatusBadRequest)
-			return
+	nextRequestID := func() string {
+		// 128 random bits, unique and unguessable
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			return fmt.Sprintf("%d", time.Now().UnixNano())
 		}
-		key := keys[0]
+		return hex.EncodeToString(b)
+	}
 
-		logger.Println("Url Param 'key' is: " + string(key))
+	// past requestTimeout the client gets a 503 and the handler's context
+	// is cancelled
+	// request body limits, -maxBodyBytes unless listed here
+	bodyLimits := map[string]int64{
+		"/barcode/decode": cfg.maxUploadBytes,
+	}
+	var handler http.Handler = limitBodies(bodyLimits, cfg.maxBodyBytes)(router)
+	if cfg.requestTimeout > 0 {
+		handler = http.TimeoutHandler(handler, cfg.requestTimeout, cfg.timeoutMessage)
+	}
 
-		// mapping to png file
-		filename := key + ".png"
-		currPath := directory + "/" + filename
-		logger.Println("Png location: " + currPath)
+	server := &http.Server{
+		Addr:         cfg.listenAddr,
+		Handler:      tracing(nextRequestID)(s.headers()(spans()(counting()(s.logging()(s.recording()(draining()(s.mount(s.measuring(router)(handler))))))))),
+		ErrorLog:     logger,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		IdleTimeout:  15 * time.Second,
+	}
 
-		// Create the barcode
-		bc, _ := code128.Encode(string(key))
+	if cfg.h2cEnabled {
+		// cleartext HTTP/2 alongside HTTP/1.1; ConfigureServer lets Shutdown
+		// send GOAWAY to the h2c connections too
+		h2s := &http2.Server{IdleTimeout: server.IdleTimeout}
+		if err := http2.ConfigureServer(server, h2s); err != nil {
+			logger.Fatalf("Could not configure HTTP/2: %v\n", err)
+		}
+		server.Handler = h2c.NewHandler(server.Handler, h2s)
+	}
 
-		// Scale the barcode to 200x200 pixels
-		scaled, _ := barcode.Scale(bc, 200, 200)
+	return server
+}
 
-		// create the output file
-		file, _ := os.Create(currPath)
-		defer file.Close()
+// runFetch : retrieve each key from the archive into directory and print
+// the local path, false when any retrieval failed
+func (s *Server) runFetch(keys string, prefix string) bool {
+	if prefix != "" {
+		fetched, failed, err := s.prefetch(context.Background(), prefix)
+		if err != nil {
+			logger.Println("unable to list archive for prefix "+prefix, err)
+			return false
+		}
+		for key, err := range failed {
+			logger.Printf("unable to fetch %q %v\n", key, err)
+		}
+		logger.Printf("prefix %s: %d fetched, %d failed\n", prefix, fetched, len(failed))
+		return len(failed) == 0
+	}
 
-		// encode the barcode as png
-		png.Encode(file, scaled)
+	ok := true
+	found := false
+	for _, key := range strings.Split(keys, ",") {
+		if key = strings.TrimSpace(key); key == "" {
+			continue
+		}
+		found = true
+		file, err := s.backend.retrieve(context.Background(), s.cfg().directory, key+".pdf")
+		if err != nil {
+			logger.Printf("unable to fetch %q %v\n", key, err)
+			ok = false
+			continue
+		}
+		fmt.Println(file.Name())
+		file.Close()
+	}
+	if !found {
+		logger.Println("fetch needs -key or -prefix")
+		return false
+	}
+	return ok
+}
 
-		// [TODO] Upload To SRVBDDLOF (directory oracle pour intéger dans le mail)
-		fmt.Fprintln(w, "L'étiquette code barre est disponible sous ", currPath)
+// prefetch : fetch every archived attestation whose key starts with prefix
+// that isn't already in directory, maxFtpFetches at a time
+func (s *Server) prefetch(ctx context.Context, prefix string) (fetched int, failed map[string]error, err error) {
+	keys, err := s.backend.list(ctx, prefix)
+	if err != nil {
+		return 0, nil, err
+	}
 
-	})
+	workers := s.cfg().maxFtpFetches
+	if workers <= 0 {
+		workers = 4
+	}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	failed = make(map[string]error)
+	work := make(chan string)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range work {
+				_, _, _, err := s.fetchDocument(ctx, key)
+				mu.Lock()
+				if err != nil {
+					failed[key] = err
+				} else {
+					fetched++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, key := range keys {
+		work <- key
+	}
+	close(work)
+	wg.Wait()
+
+	return fetched, failed, nil
+}
+
+// isReadOnly : err comes from a read-only filesystem or a write permission
+func isReadOnly(err error) bool {
+	return errors.Is(err, syscall.EROFS) || errors.Is(err, os.ErrPermission)
+}
+
+// checkDirectory : directory must exist and be writable
+func checkDirectory(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("not a directory")
+	}
+	f, err := ioutil.TempFile(dir, tempFilePrefix+"check-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// runChecks : preflight of the configuration, prints a report and returns success
+func (s *Server) runChecks() bool {
+	cfg := s.cfg()
+	ok := true
+	report := func(name string, err error) {
+		if err != nil {
+			ok = false
+			fmt.Printf("[FAIL] %s: %v\n", name, err)
+			return
+		}
+		fmt.Printf("[ OK ] %s\n", name)
+	}
+
+	report("directory "+cfg.directory+" writable", checkDirectory(cfg.directory))
+	if cfg.tempDir != "" {
+		report("temp directory "+cfg.tempDir+" writable", checkDirectory(cfg.tempDir))
+	}
+
+	switch cfg.backend {
+	case "ftp":
+		for _, srv := range s.ftpServers() {
+			c, err := s.ftpConnect(context.Background(), srv)
+			if err == nil {
+				c.Quit()
+			}
+			report("ftp "+srv+" login", err)
+		}
+	case "s3":
+		found, err := s.s3.client.BucketExists(context.Background(), s.s3.bucket)
+		if err == nil && !found {
+			err = fmt.Errorf("bucket does not exist")
+		}
+		report("s3 "+s.s3.endpoint+" bucket "+s.s3.bucket, err)
+	}
+
+	return ok
+}
+
+// servePprof : profiling handlers on their own listener, never the public one
+func servePprof(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	logger.Println("pprof is listening at", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logger.Println("pprof listener stopped", err)
+	}
+}
+
+// settings : configuration that SIGHUP can change without a restart
+type settings struct {
+	directory string
+	ftp       ftpStruc
+	debug     bool
+}
+
+// settingsFile : -configFile content, absent fields keep the flag value
+type settingsFile struct {
+	Directory *string `json:"directory"`
+	SrvFtp    *string `json:"srvFtp"`
+	UserFtp   *string `json:"userFtp"`
+	PwdFtp    *string `json:"pwdFtp"`
+	FtpDir    *string `json:"ftpDir"`
+	Debug     *bool   `json:"debug"`
+}
+
+// secretFiles : -srvFtpFile, -userFtpFile and -pwdFtpFile paths
+type secretFiles struct {
+	srvFtp  string
+	userFtp string
+	pwdFtp  string
+}
+
+// loadSettings : flag values overridden by -configFile, then by the
+// docker / kubernetes secrets mounted as files
+func loadSettings(configFile string, base settings, secrets secretFiles) (settings, error) {
+	loaded := base
+
+	if configFile != "" {
+		b, err := ioutil.ReadFile(configFile)
+		if err != nil {
+			return loaded, err
+		}
+		var file settingsFile
+		if err := json.Unmarshal(b, &file); err != nil {
+			return loaded, fmt.Errorf("%s: %v", configFile, err)
+		}
+		for _, field := range []struct {
+			value *string
+			dst   *string
+		}{
+			{file.Directory, &loaded.directory},
+			{file.SrvFtp, &loaded.ftp.srvFtp},
+			{file.UserFtp, &loaded.ftp.userFtp},
+			{file.PwdFtp, &loaded.ftp.pwdFtp},
+			{file.FtpDir, &loaded.ftp.dirFtp},
+		} {
+			if field.value != nil {
+				*field.dst = *field.value
+			}
+		}
+		if file.Debug != nil {
+			loaded.debug = *file.Debug
+		}
+	}
+
+	for _, secret := range []struct {
+		path  string
+		value *string
+	}{
+		{secrets.srvFtp, &loaded.ftp.srvFtp},
+		{secrets.userFtp, &loaded.ftp.userFtp},
+		{secrets.pwdFtp, &loaded.ftp.pwdFtp},
+	} {
+		if secret.path == "" {
+			continue
+		}
+		value, err := readSecretFile(secret.path)
+		if err != nil {
+			return loaded, fmt.Errorf("secret file %s: %v", secret.path, err)
+		}
+		*secret.value = value
+	}
+
+	return loaded, nil
+}
+
+// applySettings : swap in a copy of the configuration carrying next;
+// requests in flight keep the one they started with, pooled ftp connections
+// logged in with previous settings are closed
+func (s *Server) applySettings(next settings) {
+	prev := s.cfg()
+	cfg := *prev
+	cfg.directory = next.directory
+	cfg.ftp = next.ftp
+	cfg.debug = next.debug
+	s.config.Store(&cfg)
+
+	if cfg.ftp == prev.ftp {
+		return
+	}
+	ftpPool.Lock()
+	idle := ftpPool.idle
+	ftpPool.idle = make(map[string][]*ftp.ServerConn)
+	ftpPool.Unlock()
+	for _, conns := range idle {
+		for _, c := range conns {
+			c.Quit()
+		}
+	}
+}
+
+// readSecretFile : file content without the trailing newline
+func readSecretFile(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// loadKeyMap : replace the partner key mapping with the content of a
+// "partner,internal" csv file
+func (s *Server) loadKeyMap(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = 2
+	reader.Comment = '#'
+	records, err := reader.ReadAll()
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string]string, len(records))
+	for _, record := range records {
+		keys[strings.TrimSpace(record[0])] = strings.TrimSpace(record[1])
+	}
+
+	s.keyMap.Lock()
+	s.keyMap.keys = keys
+	s.keyMap.Unlock()
+	logger.Printf("Loaded %d partner keys\n", len(keys))
+	return nil
+}
+
+// lookupKey : internal key of a partner key
+func (s *Server) lookupKey(partner string) (string, bool) {
+	s.keyMap.RLock()
+	defer s.keyMap.RUnlock()
+	key, ok := s.keyMap.keys[partner]
+	return key, ok
+}
+
+// validateListenAddr : host:port with a numeric port in range, or unix:/path
+func validateListenAddr(addr string) error {
+	if socketPath, ok := unixSocketPath(addr); ok {
+		if socketPath == "" {
+			return fmt.Errorf("missing socket path")
+		}
+		return nil
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
+// listen : tcp listener for host:port (IPv4 or [IPv6]:port) or unix socket for unix:/path
+func listen(addr string) (net.Listener, error) {
+	if socketPath, ok := unixSocketPath(addr); ok {
+		// remove a socket left over by a previous run
+		os.Remove(socketPath)
+		return net.Listen("unix", socketPath)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// unixSocketPath : socket path when addr has the unix:/path form
+func unixSocketPath(addr string) (string, bool) {
+	if strings.HasPrefix(addr, "unix:") {
+		return strings.TrimPrefix(addr, "unix:"), true
+	}
+	return "", false
+}
+
+func (s *Server) index() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := s.cfg()
+		if r.URL.Path != "/" {
+			writeError(w, r, http.StatusNotFound, http.StatusText(http.StatusNotFound), "")
+			return
+		}
+		if cfg.indexBody != "" {
+			setContentType(w, "text/plain")
+			w.WriteHeader(http.StatusOK)
+			fmt.Fprintln(w, cfg.indexBody)
+			return
+		}
+		setContentType(w, "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{
+			"service": serviceName,
+			"version": version,
+			"uptime":  time.Since(startTime).Round(time.Second).String(),
+		})
+	})
+}
+
+// favicon : no icon, 204 keeps browsers from hitting the index 404
+func favicon() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func (s *Server) status() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setContentType(w, "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"uptime":             time.Since(startTime).Round(time.Second).String(),
+			"requests":           atomic.LoadInt64(&stats.requests),
+			"inFlight":           atomic.LoadInt64(&stats.inFlight),
+			"fallbacksSucceeded": atomic.LoadInt64(&stats.fallbacksSucceeded),
+			"fallbacksFailed":    atomic.LoadInt64(&stats.fallbacksFailed),
+			"goroutines":         runtime.NumGoroutine(),
+			"barcodesInProgress": atomic.LoadInt64(&s.barcodeWaiting),
+		})
+	})
+}
+
+// healthzData : fields of -healthzUpBody and -healthzDownBody
+type healthzData struct {
+	Status  string // UP or DOWN
+	Version string
+	Uptime  string // e.g. 1h2m3s
+}
+
+// parseHealthzBody : a /healthz body template, rendered once to reject
+// unknown fields at startup
+func parseHealthzBody(text string) (*texttemplate.Template, error) {
+	tmpl, err := texttemplate.New("healthz").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	if err := tmpl.Execute(io.Discard, healthzData{}); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+func (s *Server) healthz() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := s.cfg()
+		code, body, data := http.StatusOK, cfg.healthzUp, healthzData{Status: "UP"}
+		if atomic.LoadInt32(&healthy) != 1 {
+			code, body, data = http.StatusServiceUnavailable, cfg.healthzDown, healthzData{Status: "DOWN"}
+		}
+		data.Version = version
+		data.Uptime = time.Since(startTime).Round(time.Second).String()
+
+		var buf bytes.Buffer
+		if err := body.Execute(&buf, data); err != nil {
+			logger.Println("unable to render healthz body", err)
+			buf.Reset()
+			buf.WriteString(data.Status)
+		}
+		setContentType(w, cfg.healthzContentType)
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(code)
+		fmt.Fprintln(w, buf.String())
+	})
+}
+
+func (s *Server) generateBarCode() http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := s.cfg()
+
+		logger.Println("generateBarCode")
+
+		// get search key
+		keys, ok := r.URL.Query()["key"]
+		if !ok || len(keys[0]) < 1 {
+			writeError(w, r, http.StatusBadRequest, "missing key parameter", "")
+			return
+		}
+		key := keys[0]
+		if !validKey(key) {
+			writeError(w, r, http.StatusBadRequest, "invalid key parameter", "")
+			return
+		}
+
+		logger.Printf("Url Param 'key' is: %q\n", key)
+
+		// optional output format (default png)
+		formatName := "png"
+		if f := r.URL.Query().Get("format"); f != "" {
+			formatName = strings.ToLower(f)
+		}
+		format, ok := barcodeFormats[formatName]
+		if !ok {
+			writeError(w, r, http.StatusBadRequest, "invalid format parameter", "")
+			return
+		}
+		contentType, err := barcodeContentType(r, format)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid contentType parameter: "+err.Error(), "")
+			return
+		}
+
+		// optional jpeg quality
+		quality := jpeg.DefaultQuality
+		if q := r.URL.Query().Get("quality"); q != "" {
+			n, err := strconv.Atoi(q)
+			if err != nil || n < 1 || n > 100 || formatName != "jpeg" {
+				writeError(w, r, http.StatusBadRequest, "invalid quality parameter", "")
+				return
+			}
+			quality = n
+		}
+
+		// optional dimensions (default 200x200 pixels)
+		width, err := barcodeDimension(r, "width")
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid width parameter", "")
+			return
+		}
+		height, err := barcodeDimension(r, "height")
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid height parameter", "")
+			return
+		}
+
+		// optional module width, output width becomes modules x moduleWidth
+		moduleWidth := 0
+		if v := r.URL.Query().Get("moduleWidth"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || r.URL.Query().Get("width") != "" {
+				writeError(w, r, http.StatusBadRequest, "invalid moduleWidth parameter", "")
+				return
+			}
+			moduleWidth = n
+		}
+
+		// optional physical size for label printers, replaces width and height
+		query := r.URL.Query()
+		if query.Get("physWidth") != "" || query.Get("physHeight") != "" {
+			if query.Get("width") != "" || query.Get("height") != "" || moduleWidth > 0 {
+				writeError(w, r, http.StatusBadRequest, "physWidth/physHeight can't be combined with width, height or moduleWidth", "")
+				return
+			}
+			width, height, err = s.physicalDimensions(r)
+			if err != nil {
+				writeError(w, r, http.StatusBadRequest, "invalid physical size: "+err.Error(), "")
+				return
+			}
+		} else if query.Get("dpi") != "" || query.Get("unit") != "" {
+			writeError(w, r, http.StatusBadRequest, "dpi and unit need physWidth and physHeight", "")
+			return
+		}
+
+		// optional quiet zone in pixels, code128 asks for 10 modules by default
+		margin := -1
+		if v := r.URL.Query().Get("margin"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 || n > maxBarcodeMargin {
+				writeError(w, r, http.StatusBadRequest, "invalid margin parameter", "")
+				return
+			}
+			margin = n
+		}
+
+		// optional caption with the key under the bars
+		caption := r.URL.Query().Get("caption") == "true"
+		fontSize := defaultCaptionSize
+		if v := r.URL.Query().Get("fontSize"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < minCaptionSize || n > maxCaptionSize {
+				writeError(w, r, http.StatusBadRequest, "invalid fontSize parameter", "")
+				return
+			}
+			fontSize = n
+		}
+
+		// transparent background for colored label stock, png only
+		transparent := r.URL.Query().Get("transparent") == "true"
+		if transparent && formatName != "png" {
+			writeError(w, r, http.StatusBadRequest, "transparent is only supported with png", "")
+			return
+		}
+
+		// non-default options are part of the filename so a cached image
+		// is only reused for an identical request
+		var variant []string
+		if width != defaultBarcodeSize || height != defaultBarcodeSize {
+			variant = append(variant, fmt.Sprintf("%dx%d", width, height))
+		}
+		if quality != jpeg.DefaultQuality {
+			variant = append(variant, fmt.Sprintf("q%d", quality))
+		}
+		if caption {
+			variant = append(variant, fmt.Sprintf("caption%d", fontSize))
+		}
+		if moduleWidth > 0 {
+			variant = append(variant, fmt.Sprintf("m%d", moduleWidth))
+		}
+		if margin >= 0 {
+			variant = append(variant, fmt.Sprintf("margin%d", margin))
+		}
+		if transparent {
+			variant = append(variant, "transparent")
+		}
+
+		// mapping to image file
+		filename := key + format.ext
+		if len(variant) > 0 {
+			filename = key + "_" + strings.Join(variant, "_") + format.ext
+		}
+		currPath := cfg.directory + "/" + filename
+		logger.Println("Barcode location: " + currPath + " (" + format.contentType + ")")
+
+		// in-memory cache replaces the directory when enabled
+		if s.barcodeCache != nil {
+			if r.URL.Query().Get("force") != "true" {
+				if data, ok := s.barcodeCache.get(filename); ok {
+					s.debugln("Barcode served from memory: " + filename)
+					s.writeBarcode(w, contentType, data)
+					return
+				}
+			}
+		}
+
+		writable := s.barcodeCache == nil && atomic.LoadInt32(&s.readOnlyDirectory) == 0
+
+		// reuse the cached image unless ?force=true
+		if writable && r.URL.Query().Get("force") != "true" {
+			if info, err := os.Stat(currPath); err == nil && info.Mode().IsRegular() && info.Size() > 0 {
+				logger.Println("Barcode already generated: " + currPath)
+				s.writeBarcodeLocation(w, currPath)
+				return
+			}
+		}
+
+		// encoding is cpu bound, keep bursts off the attestation path
+		release, err := s.acquireBarcodeWorker(r.Context())
+		if err != nil {
+			logger.Println("barcode workers busy", err)
+			w.Header().Set("Retry-After", "1")
+			writeError(w, r, http.StatusServiceUnavailable, "too many barcodes in progress", "")
+			return
+		}
+		defer release()
+
+		// Create the barcode
+		bc, err := code128.Encode(string(key))
+		if err != nil && r.URL.Query().Get("placeholder") == "true" {
+			// a visible placeholder instead of a broken image in the ui
+			logger.Println("unable to encode barcode, returning a placeholder", err)
+			var buf bytes.Buffer
+			if err := s.encodePlaceholder(&buf, key, width, height, formatName, quality); err != nil {
+				logger.Println("unable to draw placeholder", err)
+				writeError(w, r, http.StatusInternalServerError, "unable to draw placeholder", "")
+				return
+			}
+			w.Header().Set("X-Barcode-Placeholder", "true")
+			w.Header().Set("Cache-Control", "no-store")
+			s.writeBarcode(w, contentType, buf.Bytes())
+			return
+		}
+		if err != nil {
+			logger.Println("unable to encode barcode", err)
+			writeError(w, r, http.StatusBadRequest, "key can't be encoded as code128", "")
+			return
+		}
+
+		// one pixel per module before scaling
+		modules := bc.Bounds().Dx()
+		w.Header().Set("X-Barcode-Modules", strconv.Itoa(modules))
+		if moduleWidth > 0 {
+			width = modules * moduleWidth
+			if width > maxBarcodeSize {
+				writeError(w, r, http.StatusBadRequest, "moduleWidth too large for this key", "")
+				return
+			}
+		}
+		// barcode.Scale can't draw a module narrower than a pixel
+		if width < modules {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("width smaller than %d modules", modules), "")
+			return
+		}
+
+		if margin < 0 {
+			margin = quietZoneModules * max(width/modules, 1)
+		}
+
+		var buf bytes.Buffer
+		if formatName == "svg" {
+			// bars drawn as rectangles, no rasterization
+			encodeSVG(&buf, bc, width, height, margin, caption, key, fontSize)
+		} else {
+			// Scale the barcode to the requested pixels
+			img, err := scaleBarcode(bc, width, height, margin)
+			if err != nil {
+				logger.Println("unable to scale barcode", err)
+				writeError(w, r, http.StatusBadRequest, "unable to scale barcode: "+err.Error(), "")
+				return
+			}
+
+			if caption {
+				img, err = addCaption(img, key, fontSize)
+				if err != nil {
+					logger.Println("unable to draw barcode caption", err)
+					writeError(w, r, http.StatusInternalServerError, "unable to draw caption", "")
+					return
+				}
+			}
+			if transparent {
+				img = whiteToTransparent(img)
+			}
+
+			// encode the barcode in the requested format
+			if err := s.encodeImage(&buf, img, formatName, quality); err != nil {
+				logger.Println("unable to encode barcode", err)
+				writeError(w, r, http.StatusInternalServerError, "unable to write barcode", "")
+				return
+			}
+		}
+		s.metrics.IncBarcode(formatName)
+
+		if s.barcodeCache != nil {
+			s.barcodeCache.add(filename, buf.Bytes())
+		}
+		if !writable {
+			s.debugln("Barcode returned without writing: " + filename)
+			s.writeBarcode(w, contentType, buf.Bytes())
+			return
+		}
+
+		// write the output file, within -maxDirBytes
+		if err := s.writeWithinQuota(currPath, buf.Bytes()); err != nil {
+			if isReadOnly(err) {
+				logger.Println("directory not writable, barcode returned without writing", err)
+				s.writeBarcode(w, contentType, buf.Bytes())
+				return
+			}
+			logger.Println("unable to write barcode file", err)
+			if errors.Is(err, errQuotaExceeded) {
+				writeError(w, r, http.StatusInsufficientStorage, "directory quota exceeded", "")
+				return
+			}
+			writeError(w, r, http.StatusInternalServerError, "unable to write barcode", "")
+			return
+		}
+
+		// [TODO] Upload To SRVBDDLOF (directory oracle pour intéger dans le mail)
+		if cfg.notifyURL != "" {
+			go s.notifyBarcode(key, currPath)
+		}
+		s.writeBarcodeLocation(w, currPath)
+
+	})
+}
+
+func decodeBarCode() http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		logger.Println("decodeBarCode")
+
+		file, _, err := r.FormFile("image")
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("image larger than %d bytes", tooLarge.Limit), "")
+			return
+		}
+		if err != nil {
+			logger.Println("unable to read uploaded image", err)
+			writeError(w, r, http.StatusBadRequest, "missing image file", "")
+			return
+		}
+		defer file.Close()
+
+		img, _, err := image.Decode(file)
+		if err != nil {
+			logger.Println("unable to decode uploaded image", err)
+			writeError(w, r, http.StatusUnprocessableEntity, "unreadable image", "")
+			return
+		}
+
+		bmp, err := gozxing.NewBinaryBitmapFromImage(img)
+		if err != nil {
+			logger.Println("unable to binarize uploaded image", err)
+			writeError(w, r, http.StatusUnprocessableEntity, "unreadable image", "")
+			return
+		}
+
+		// labels are code128, qrcodes come from /sampleIdToQrCode
+		for _, reader := range []gozxing.Reader{oned.NewCode128Reader(), qrcode.NewQRCodeReader()} {
+			result, err := reader.Decode(bmp, nil)
+			if err != nil {
+				continue
+			}
+			logger.Println("Decoded barcode: " + result.GetText())
+			setContentType(w, "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"key": result.GetText()})
+			return
+		}
+
+		writeError(w, r, http.StatusUnprocessableEntity, "no barcode found in image", "")
+	})
+}
+
+// captionFace : Go Regular at fontSize pixels
+func captionFace(fontSize int) (font.Face, error) {
+	parsed, err := opentype.Parse(goregular.TTF)
+	if err != nil {
+		return nil, err
+	}
+	return opentype.NewFace(parsed, &opentype.FaceOptions{
+		Size:    float64(fontSize),
+		DPI:     72,
+		Hinting: font.HintingFull,
+	})
+}
+
+// addCaption : draw text centered on a white band under img
+func addCaption(img image.Image, text string, fontSize int) (image.Image, error) {
+	face, err := captionFace(fontSize)
+	if err != nil {
+		return nil, err
+	}
+	defer face.Close()
+
+	metrics := face.Metrics()
+	padding := fontSize / 2
+	bounds := img.Bounds()
+	bandHeight := metrics.Height.Ceil() + 2*padding
+
+	canvas := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()+bandHeight))
+	draw.Draw(canvas, canvas.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(canvas, bounds.Sub(bounds.Min), img, bounds.Min, draw.Src)
+
+	drawer := &font.Drawer{Dst: canvas, Src: image.Black, Face: face}
+	textWidth := drawer.MeasureString(text).Ceil()
+	drawer.Dot = fixed.P((bounds.Dx()-textWidth)/2, bounds.Dy()+padding+metrics.Ascent.Ceil())
+	drawer.DrawString(text)
+
+	return canvas, nil
+}
+
+// writeFileAtomic : write data to a temp file next to path and rename it over
+// path, concurrent writers of the same file never leave a truncated image
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), tempFilePrefix+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// writeWithinQuota : write data to path, evicting the oldest files of its
+// directory first when the write would exceed maxDirBytes
+func (s *Server) writeWithinQuota(path string, data []byte) error {
+	cfg := s.cfg()
+	if cfg.maxDirBytes <= 0 {
+		return writeFileAtomic(path, data)
+	}
+
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+
+	dir := filepath.Dir(path)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var files []os.FileInfo
+	var used int64
+	for _, info := range infos {
+		// in-progress downloads aren't ours to evict
+		if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), tempFilePrefix) {
+			continue
+		}
+		if info.Name() == filepath.Base(path) {
+			// overwritten by this write
+			continue
+		}
+		files = append(files, info)
+		used += info.Size()
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+	need := used + int64(len(data)) - cfg.maxDirBytes
+	for _, info := range files {
+		if need <= 0 {
+			break
+		}
+		if err := os.Remove(filepath.Join(dir, info.Name())); err != nil {
+			logger.Println("unable to evict "+info.Name(), err)
+			continue
+		}
+		os.Remove(filepath.Join(dir, info.Name()+fetchedSuffix))
+		s.debugln("Evicted " + info.Name() + " to stay under maxDirBytes")
+		need -= info.Size()
+	}
+	if need > 0 {
+		return errQuotaExceeded
+	}
+
+	return writeFileAtomic(path, data)
+}
+
+// notifyClient : http client of the barcode notifications
+var notifyClient = &http.Client{Timeout: 10 * time.Second}
+
+// notifyBarcode : POST key, path and timestamp to -notifyURL, retrying with
+// backoff; failures are only logged
+func (s *Server) notifyBarcode(key string, path string) {
+	body, err := json.Marshal(map[string]interface{}{
+		"key":       key,
+		"path":      path,
+		"timestamp": time.Now().UTC().Format(time.RFC3339),
+	})
+	if err != nil {
+		logger.Println("unable to encode barcode notification", err)
+		return
+	}
+
+	delay := time.Second
+	for attempt := 1; attempt <= notifyAttempts; attempt++ {
+		resp, err := notifyClient.Post(s.cfg().notifyURL, "application/json", bytes.NewReader(body))
+		if err == nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return
+			}
+			err = fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		logger.Printf("barcode notification for %q failed (attempt %d/%d): %v\n", key, attempt, notifyAttempts, err)
+		if attempt < notifyAttempts {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+}
+
+// lruCache : byte slices bounded by their total size, least recently used
+// entries are evicted first
+type lruCache struct {
+	sync.Mutex
+	maxBytes int64
+	size     int64
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+type lruEntry struct {
+	key  string
+	data []byte
+}
+
+func newLRUCache(maxBytes int64) *lruCache {
+	return &lruCache{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (c *lruCache) get(key string) ([]byte, bool) {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*lruEntry).data, true
+}
+
+func (c *lruCache) add(key string, data []byte) {
+	if int64(len(data)) > c.maxBytes {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.size += int64(len(data)) - int64(len(e.Value.(*lruEntry).data))
+		e.Value.(*lruEntry).data = data
+		c.order.MoveToFront(e)
+	} else {
+		c.entries[key] = c.order.PushFront(&lruEntry{key: key, data: data})
+		c.size += int64(len(data))
+	}
+	for c.size > c.maxBytes {
+		oldest := c.order.Back()
+		entry := oldest.Value.(*lruEntry)
+		c.order.Remove(oldest)
+		delete(c.entries, entry.key)
+		c.size -= int64(len(entry.data))
+	}
+}
+
+// removePrefix : drop the entries whose key starts with prefix, returns their count
+func (c *lruCache) removePrefix(prefix string) int {
+	c.Lock()
+	defer c.Unlock()
+	removed := 0
+	for key, e := range c.entries {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		c.order.Remove(e)
+		delete(c.entries, key)
+		c.size -= int64(len(e.Value.(*lruEntry).data))
+		removed++
+	}
+	return removed
+}
+
+// whiteToTransparent : RGBA copy of img with the white pixels fully transparent
+func whiteToTransparent(img image.Image) image.Image {
+	bounds := img.Bounds()
+	out := image.NewNRGBA(bounds)
+	draw.Draw(out, bounds, img, bounds.Min, draw.Src)
+	for i := 0; i < len(out.Pix); i += 4 {
+		if out.Pix[i] == 0xff && out.Pix[i+1] == 0xff && out.Pix[i+2] == 0xff {
+			out.Pix[i+3] = 0
+		}
+	}
+	return out
+}
+
+// addMargin : pad the image with a white border of margin pixels on all sides
+func addMargin(img image.Image, margin int) image.Image {
+	if margin == 0 {
+		return img
+	}
+	bounds := img.Bounds()
+	canvas := image.NewRGBA(image.Rect(0, 0, bounds.Dx()+2*margin, bounds.Dy()+2*margin))
+	draw.Draw(canvas, canvas.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(canvas, bounds.Sub(bounds.Min).Add(image.Pt(margin, margin)), img, bounds.Min, draw.Src)
+	return canvas
+}
+
+// barcodeDimension : width or height query parameter, defaultBarcodeSize when absent
+func barcodeDimension(r *http.Request, name string) (int, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return defaultBarcodeSize, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, err
+	}
+	if n < 1 || n > maxBarcodeSize {
+		return 0, fmt.Errorf("%s out of range", name)
+	}
+	return n, nil
+}
+
+// physicalDimensions : pixel size of a physWidth x physHeight label, in unit
+// (mm by default, or in), printed at dpi (default -barcodeDpi):
+// pixels = round(inches x dpi) = round(mm / 25.4 x dpi)
+func (s *Server) physicalDimensions(r *http.Request) (int, int, error) {
+	query := r.URL.Query()
+
+	dpi := s.cfg().barcodeDpi
+	if v := query.Get("dpi"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < minBarcodeDpi || n > maxBarcodeDpi {
+			return 0, 0, fmt.Errorf("dpi must be between %d and %d", minBarcodeDpi, maxBarcodeDpi)
+		}
+		dpi = n
+	}
+
+	perInch := 25.4
+	switch query.Get("unit") {
+	case "", "mm":
+	case "in":
+		perInch = 1
+	default:
+		return 0, 0, fmt.Errorf("unit must be mm or in")
+	}
+
+	var pixels [2]int
+	for i, name := range []string{"physWidth", "physHeight"} {
+		size, err := strconv.ParseFloat(query.Get(name), 64)
+		if err != nil || size <= 0 {
+			return 0, 0, fmt.Errorf("%s must be a positive number", name)
+		}
+		pixels[i] = int(math.Round(size / perInch * float64(dpi)))
+		if pixels[i] < 1 || pixels[i] > maxBarcodeSize {
+			return 0, 0, fmt.Errorf("%s is %d pixels at %d dpi (max %d)", name, pixels[i], dpi, maxBarcodeSize)
+		}
+	}
+	return pixels[0], pixels[1], nil
+}
+
+// barcodeFormat : file extension and mime type of a barcode output format
+type barcodeFormat struct {
+	ext         string
+	contentType string
+}
+
+var barcodeFormats = map[string]barcodeFormat{
+	"png":  {ext: ".png", contentType: "image/png"},
+	"jpeg": {ext: ".jpg", contentType: "image/jpeg"},
+	"gif":  {ext: ".gif", contentType: "image/gif"},
+	"svg":  {ext: ".svg", contentType: "image/svg+xml"},
+}
+
+// encodeSVG : bars of bc as rectangles; the viewBox unit is one module so
+// every bar edge lands on a whole coordinate, width and height in pixels
+// give the default rendering size
+func encodeSVG(w io.Writer, bc barcode.Barcode, width int, height int, margin int, caption bool, text string, fontSize int) {
+	modules := bc.Bounds().Dx()
+	module := float64(width) / float64(modules)
+
+	totalHeight := height + 2*margin
+	if caption {
+		// same band as addCaption: padding, line height, padding
+		totalHeight += fontSize*6/5 + fontSize
+	}
+	totalWidth := width + 2*margin
+
+	fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %g %g" shape-rendering="crispEdges">`+"\n",
+		totalWidth, totalHeight, float64(totalWidth)/module, float64(totalHeight)/module)
+	fmt.Fprintf(w, `<rect width="100%%" height="100%%" fill="#fff"/>`+"\n")
+	fmt.Fprintf(w, `<g fill="#000" transform="translate(%g %g)">`+"\n", float64(margin)/module, float64(margin)/module)
+	y := bc.Bounds().Min.Y
+	for x := bc.Bounds().Min.X; x < bc.Bounds().Max.X; {
+		if r, _, _, _ := bc.At(x, y).RGBA(); r != 0 {
+			x++
+			continue
+		}
+		start := x
+		for x < bc.Bounds().Max.X {
+			if r, _, _, _ := bc.At(x, y).RGBA(); r != 0 {
+				break
+			}
+			x++
+		}
+		fmt.Fprintf(w, `<rect x="%d" width="%d" height="%g"/>`+"\n", start-bc.Bounds().Min.X, x-start, float64(height)/module)
+	}
+	fmt.Fprintf(w, "</g>\n")
+	if caption {
+		baseline := float64(margin+height+fontSize/2+fontSize) / module
+		fmt.Fprintf(w, `<text x="%g" y="%g" font-family="sans-serif" font-size="%g" text-anchor="middle">%s</text>`+"\n",
+			float64(totalWidth)/2/module, baseline, float64(fontSize)/module, html.EscapeString(text))
+	}
+	fmt.Fprintf(w, "</svg>\n")
+}
+
+// acquireBarcodeWorker : wait for one of the -barcodeWorkers slots, behind at
+// most -barcodeQueue other requests, until ctx is done
+func (s *Server) acquireBarcodeWorker(ctx context.Context) (release func(), err error) {
+	cfg := s.cfg()
+	if atomic.AddInt64(&s.barcodeWaiting, 1) > int64(cfg.barcodeWorkers+cfg.barcodeQueue) {
+		atomic.AddInt64(&s.barcodeWaiting, -1)
+		return nil, errBarcodeQueueFull
+	}
+	select {
+	case s.barcodeSlots <- struct{}{}:
+		return func() {
+			<-s.barcodeSlots
+			atomic.AddInt64(&s.barcodeWaiting, -1)
+		}, nil
+	case <-ctx.Done():
+		atomic.AddInt64(&s.barcodeWaiting, -1)
+		return nil, ctx.Err()
+	}
+}
+
+// barcodeContentType : mime type of format, or ?contentType= for downstream
+// systems wanting e.g. application/octet-stream; only octet-stream and raster
+// image types are accepted so the bytes are never rendered as a document
+func barcodeContentType(r *http.Request, format barcodeFormat) (string, error) {
+	override := r.URL.Query().Get("contentType")
+	if override == "" {
+		return format.contentType, nil
+	}
+	mediaType, _, err := mime.ParseMediaType(override)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case mediaType == format.contentType, mediaType == "application/octet-stream", mediaType == "binary/octet-stream":
+	case strings.HasPrefix(mediaType, "image/") && mediaType != "image/svg+xml":
+	default:
+		return "", fmt.Errorf("%s not allowed", mediaType)
+	}
+	return mediaType, nil
+}
+
+// writeBarcode : image bytes with their content type
+func (s *Server) writeBarcode(w http.ResponseWriter, contentType string, data []byte) {
+	setCacheControl(w, s.cfg().barcodeCacheControl)
+	setContentType(w, contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+// writeBarcodeLocation : text answer naming the file written in directory
+func (s *Server) writeBarcodeLocation(w http.ResponseWriter, currPath string) {
+	setCacheControl(w, s.cfg().barcodeCacheControl)
+	setContentType(w, "text/plain")
+	fmt.Fprintln(w, "L'étiquette code barre est disponible sous ", currPath)
+}
+
+// encodePlaceholder : width x height "invalid key" image naming key, in the
+// requested format, for keys code128 can't encode
+func (s *Server) encodePlaceholder(w io.Writer, key string, width int, height int, formatName string, quality int) error {
+	text := "invalid key: " + key
+	if formatName == "svg" {
+		_, err := fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`+"\n"+
+			`<rect width="100%%" height="100%%" fill="#fff" stroke="#c00" stroke-width="2"/>`+"\n"+
+			`<text x="50%%" y="50%%" font-family="sans-serif" font-size="%d" text-anchor="middle" dominant-baseline="middle" fill="#c00">%s</text>`+"\n</svg>\n",
+			width, height, width, height, defaultCaptionSize, html.EscapeString(text))
+		return err
+	}
+
+	face, err := captionFace(defaultCaptionSize)
+	if err != nil {
+		return err
+	}
+	defer face.Close()
+
+	canvas := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(canvas, canvas.Bounds(), image.White, image.Point{}, draw.Src)
+	red := image.NewUniform(color.RGBA{R: 0xcc, A: 0xff})
+	for x := 0; x < width; x++ {
+		canvas.Set(x, 0, red.C)
+		canvas.Set(x, height-1, red.C)
+	}
+	for y := 0; y < height; y++ {
+		canvas.Set(0, y, red.C)
+		canvas.Set(width-1, y, red.C)
+	}
+
+	drawer := &font.Drawer{Dst: canvas, Src: red, Face: face}
+	metrics := face.Metrics()
+	textWidth := drawer.MeasureString(text).Ceil()
+	drawer.Dot = fixed.P((width-textWidth)/2, (height+metrics.Ascent.Ceil()-metrics.Descent.Ceil())/2)
+	drawer.DrawString(text)
+
+	return s.encodeImage(w, canvas, formatName, quality)
+}
+
+// encodeImage : write img with the encoder of the given format
+func (s *Server) encodeImage(w io.Writer, img image.Image, formatName string, quality int) error {
+	switch formatName {
+	case "jpeg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	case "gif":
+		return gif.Encode(w, img, nil)
+	default:
+		return s.pngEncoder.Encode(w, img)
+	}
+}
+
+func (s *Server) generateQrCode() http.Handler {
+
+	levels := map[string]qr.ErrorCorrectionLevel{
+		"L": qr.L,
+		"M": qr.M,
+		"Q": qr.Q,
+		"H": qr.H,
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		logger.Println("generateQrCode")
+
+		// get search key
+		keys, ok := r.URL.Query()["key"]
+		if !ok || len(keys[0]) < 1 {
+			writeError(w, r, http.StatusBadRequest, "missing key parameter", "")
+			return
+		}
+		key := keys[0]
+		if !validKey(key) {
+			writeError(w, r, http.StatusBadRequest, "invalid key parameter", "")
+			return
+		}
+
+		logger.Printf("Url Param 'key' is: %q\n", key)
+
+		// optional error correction level (default M)
+		level := qr.M
+		if l := r.URL.Query().Get("level"); l != "" {
+			lvl, ok := levels[strings.ToUpper(l)]
+			if !ok {
+				writeError(w, r, http.StatusBadRequest, "invalid level parameter", "")
+				return
+			}
+			level = lvl
+		}
+
+		contentType, err := barcodeContentType(r, barcodeFormats["png"])
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, "invalid contentType parameter: "+err.Error(), "")
+			return
+		}
+
+		// build the attestation url
+		link := strings.TrimRight(s.cfg().baseURL, "/") + "/attestation?key=" + url.QueryEscape(key)
+		logger.Println("QrCode url: " + link)
+
+		release, err := s.acquireBarcodeWorker(r.Context())
+		if err != nil {
+			logger.Println("barcode workers busy", err)
+			w.Header().Set("Retry-After", "1")
+			writeError(w, r, http.StatusServiceUnavailable, "too many barcodes in progress", "")
+			return
+		}
+		defer release()
+
+		// Create the qrcode
+		qrCode, err := qr.Encode(link, level, qr.Auto)
+		if err != nil {
+			logger.Println("unable to encode qrcode", err)
+			writeError(w, r, http.StatusInternalServerError, "unable to encode qrcode", "")
+			return
+		}
+
+		// Scale the qrcode to 200x200 pixels
+		scaled, err := barcode.Scale(qrCode, 200, 200)
+		if err != nil {
+			logger.Println("unable to scale qrcode", err)
+			writeError(w, r, http.StatusInternalServerError, "unable to scale qrcode", "")
+			return
+		}
+
+		// encode the qrcode as png
+		var buf bytes.Buffer
+		if err := s.pngEncoder.Encode(&buf, scaled); err != nil {
+			logger.Println("unable to encode qrcode", err)
+			writeError(w, r, http.StatusInternalServerError, "unable to write qrcode", "")
+			return
+		}
+		s.writeBarcode(w, contentType, buf.Bytes())
+	})
+}
+
+// resolveKey : the sample id a request for key is about; checks the links of
+// /attestation/sign and translates partner references, answering the
+// request itself when it returns false
+func (s *Server) resolveKey(w http.ResponseWriter, r *http.Request, key string) (string, bool) {
+	// links of /attestation/sign, checked before the key is translated
+	query := r.URL.Query()
+	if query.Has("sig") || query.Has("exp") {
+		if err := s.verifySignedURL(key, query.Get("keyType"), query.Get("exp"), query.Get("sig"), time.Now()); err != nil {
+			logger.Printf("signed url refused for %q %v\n", key, err)
+			writeError(w, r, http.StatusForbidden, "invalid or expired link", "")
+			return key, false
+		}
+	}
+
+	// partner references are translated to our sample id
+	if query.Get("keyType") == "partner" {
+		internal, ok := s.lookupKey(key)
+		if !ok {
+			logger.Printf("unknown partner key %q\n", key)
+			writeError(w, r, http.StatusNotFound, "attestation not found", pdfNotFoundPages[preferredLanguage(r)])
+			return key, false
+		}
+		key = internal
+	}
+	return key, true
+}
+
+// openDocument : the cached document at currPath as delivered, stamped with
+// -watermark when it is a pdf; modTime is zero for a stamped copy, made per
+// delivery
+func (s *Server) openDocument(currPath string, filename string) (content io.ReadSeekCloser, modTime time.Time, err error) {
+	f, err := os.Open(currPath)
+	if err != nil {
+		return nil, modTime, fmt.Errorf("%w: %v", errDocumentNotFound, err)
+	}
+	if s.cfg().watermark == "" || !isPdf(filename) {
+		info, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, modTime, fmt.Errorf("%w: %v", errDocumentNotFound, err)
+		}
+		return f, info.ModTime(), nil
+	}
+	defer f.Close()
+	stamped, err := s.stampPdf(f, time.Now())
+	if err != nil {
+		return nil, modTime, err
+	}
+	return nopSeekCloser{bytes.NewReader(stamped)}, modTime, nil
+}
+
+// nopSeekCloser : in-memory content handed out as a file
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopSeekCloser) Close() error { return nil }
+
+func (s *Server) attestationPdf() http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := s.cfg()
+
+		logger.Println("attestation")
+		start := time.Now()
+
+		// get search key
+		keys, ok := r.URL.Query()["key"]
+		if !ok || len(keys[0]) < 1 {
+			writeError(w, r, http.StatusBadRequest, "missing key parameter", "")
+			return
+		}
+		key := keys[0]
+		if !validKey(key) {
+			writeError(w, r, http.StatusBadRequest, "invalid key parameter", "")
+			return
+		}
+
+		logger.Printf("Url Param 'key' is: %q\n", key)
+		logger.Println("directory is: " + cfg.directory)
+
+		key, ok = s.resolveKey(w, r, key)
+		if !ok {
+			return
+		}
+
+		// first available format, pdf unless -documentExtensions says otherwise
+		currPath, filename, source, err := s.fetchDocument(r.Context(), key)
+		if err != nil {
+			writeFetchError(w, r, key, err)
+			return
+		}
+
+		// one audit entry per delivered document; a write failing mid-stream
+		// (WriteTimeout on a large pdf, client gone) leaves a truncated file
+		// the client can't tell from a complete one
+		rec := &responseRecorder{ResponseWriter: w}
+		w = rec
+		defer func() {
+			if rec.err != nil {
+				logger.Printf("WARN attestation %q truncated after %d bytes (source %s, %s since the request): %v\n",
+					key, rec.size, source, time.Since(start).Round(time.Millisecond), rec.err)
+			}
+			if s.auditLog == nil || r.Method != http.MethodGet {
+				return
+			}
+			if status := rec.statusCode(); status == http.StatusOK || status == http.StatusPartialContent {
+				s.auditLog.record(r, s.clientIP(r), key, source, rec.size)
+			}
+		}()
+
+		if source == sourceStale {
+			w.Header().Set("Warning", `110 - "Response is Stale"`)
+		}
+		setCacheControl(w, cfg.attestationCacheControl)
+
+		// inline by default, attachment when ?download=true
+		disposition := "inline"
+		if r.URL.Query().Get("download") == "true" {
+			disposition = "attachment"
+		}
+		// FormatMediaType escapes spaces and encodes non-ASCII names (RFC 2231)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": filename}))
+
+		setContentType(w, s.documentContentType(filename))
+
+		// stamped per delivery, the cached file stays the original
+		content, modTime, err := s.openDocument(currPath, filename)
+		if errors.Is(err, errDocumentNotFound) {
+			logger.Println("unable to open document", err)
+			writeError(w, r, http.StatusNotFound, "attestation not found", pdfNotFoundPages[preferredLanguage(r)])
+			return
+		}
+		if err != nil {
+			logger.Printf("unable to stamp pdf %q %v\n", filename, err)
+			writeError(w, r, http.StatusInternalServerError, "unable to stamp attestation", "")
+			return
+		}
+		defer content.Close()
+		if modTime.IsZero() {
+			w.Header().Set("Cache-Control", "no-store")
+		}
+
+		// Last-Modified / If-Modified-Since from the archive's copy, kept
+		// as the mtime of the local file
+		http.ServeContent(w, r, filename, modTime, content)
+	})
+}
+
+// signAttestation : time-limited /attestation link for key, shareable without
+// the api key
+func (s *Server) signAttestation() http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := s.cfg()
+
+		logger.Println("signAttestation")
+
+		query := r.URL.Query()
+		key := query.Get("key")
+		if key == "" {
+			writeError(w, r, http.StatusBadRequest, "missing key parameter", "")
+			return
+		}
+		keyType := query.Get("keyType")
+		if keyType != "" && keyType != "partner" {
+			writeError(w, r, http.StatusBadRequest, "invalid keyType parameter", "")
+			return
+		}
+
+		ttl := cfg.signedURLTTL
+		if v := query.Get("ttl"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 || d > cfg.signedURLMaxTTL {
+				writeError(w, r, http.StatusBadRequest, fmt.Sprintf("invalid ttl parameter (max %s)", cfg.signedURLMaxTTL), "")
+				return
+			}
+			ttl = d
+		}
+
+		expires := time.Now().Add(ttl).Truncate(time.Second)
+		exp := strconv.FormatInt(expires.Unix(), 10)
+		params := url.Values{}
+		params.Set("key", key)
+		if keyType != "" {
+			params.Set("keyType", keyType)
+		}
+		params.Set("exp", exp)
+		params.Set("sig", s.signURL(key, keyType, exp))
+		link := strings.TrimRight(cfg.baseURL, "/") + "/attestation?" + params.Encode()
+
+		setContentType(w, "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"url":     link,
+			"expires": expires.UTC(),
+		})
+	})
+}
+
+// signURL : hex hmac-sha256 of the attestation link parameters with -signingKey
+func (s *Server) signURL(key string, keyType string, exp string) string {
+	mac := hmac.New(sha256.New, []byte(s.cfg().signingKey))
+	mac.Write([]byte(key + "\n" + keyType + "\n" + exp))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifySignedURL : nil when sig was made by signURL and exp hasn't passed
+func (s *Server) verifySignedURL(key string, keyType string, exp string, sig string, now time.Time) error {
+	if s.cfg().signingKey == "" {
+		return errors.New("signed urls are disabled")
+	}
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid exp %q", exp)
+	}
+	if !hmac.Equal([]byte(strings.ToLower(sig)), []byte(s.signURL(key, keyType, exp))) {
+		return errors.New("bad signature")
+	}
+	if now.Unix() > expires {
+		return fmt.Errorf("expired at %s", time.Unix(expires, 0).UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// attestationEntry : cached attestation listed by /attestations
+type attestationEntry struct {
+	Key     string    `json:"key"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+func (s *Server) listAttestations() http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		logger.Println("listAttestations")
+
+		query := r.URL.Query()
+		prefix := query.Get("prefix")
+		details := query.Get("details") == "true"
+
+		// pagination
+		offset, limit := 0, defaultListLimit
+		if v := query.Get("offset"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				writeError(w, r, http.StatusBadRequest, "invalid offset parameter", "")
+				return
+			}
+			offset = n
+		}
+		if v := query.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxListLimit {
+				writeError(w, r, http.StatusBadRequest, "invalid limit parameter", "")
+				return
+			}
+			limit = n
+		}
+
+		files, err := ioutil.ReadDir(s.cfg().directory)
+		if err != nil {
+			logger.Println("unable to read directory", err)
+			writeError(w, r, http.StatusInternalServerError, "unable to list attestations", "")
+			return
+		}
+
+		// ReadDir sorts by name so pages are stable
+		entries := []attestationEntry{}
+		for _, f := range files {
+			name := f.Name()
+			if !f.Mode().IsRegular() || filepath.Ext(name) != ".pdf" || strings.HasPrefix(name, tempFilePrefix) {
+				continue
+			}
+			key := strings.TrimSuffix(name, ".pdf")
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			entries = append(entries, attestationEntry{Key: key, Size: f.Size(), ModTime: f.ModTime()})
+		}
+
+		w.Header().Set("X-Total-Count", strconv.Itoa(len(entries)))
+		if offset > len(entries) {
+			offset = len(entries)
+		}
+		end := offset + limit
+		if end > len(entries) {
+			end = len(entries)
+		}
+		page := entries[offset:end]
+
+		setContentType(w, "application/json")
+		if details {
+			json.NewEncoder(w).Encode(page)
+			return
+		}
+		keys := make([]string, 0, len(page))
+		for _, e := range page {
+			keys = append(keys, e.Key)
+		}
+		json.NewEncoder(w).Encode(keys)
+	})
+}
+
+// ftpFileEntry : one file of an ftp LIST
+type ftpFileEntry struct {
+	Name    string    `json:"name"`
+	Size    uint64    `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// listFtp : cooldown state of every ftp server and the LIST of the archive
+// directory on ?server= (default: first candidate), filtered by ?prefix=
+func (s *Server) listFtp() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		prefix := query.Get("prefix")
+		logger.Println("listFtp prefix=" + prefix)
+
+		servers := []map[string]interface{}{}
+		for _, srv := range s.ftpServers() {
+			servers = append(servers, map[string]interface{}{"server": srv, "available": ftpAvailable(srv)})
+		}
+
+		server := query.Get("server")
+		if server == "" {
+			if candidates := s.ftpCandidates(); len(candidates) > 0 {
+				server = candidates[0]
+			}
+		} else if !slices.Contains(s.ftpServers(), server) {
+			writeError(w, r, http.StatusBadRequest, "server is not one of -srvFtp", "")
+			return
+		}
+		if server == "" {
+			writeError(w, r, http.StatusServiceUnavailable, "no ftp server configured", "")
+			return
+		}
+
+		c, err := s.getFtpConn(r.Context(), server)
+		if err != nil {
+			s.markFtpFailure(server)
+			logger.Println("unable to connect to "+server, err)
+			writeError(w, r, http.StatusBadGateway, "unable to connect to "+server, "")
+			return
+		}
+		entries, err := c.List("")
+		s.releaseFtpConn(server, c, err)
+		if err != nil {
+			logger.Println("unable to list files on "+server, err)
+			writeError(w, r, http.StatusBadGateway, "unable to list files on "+server, "")
+			return
+		}
+
+		files := []ftpFileEntry{}
+		for _, e := range entries {
+			name := s.ftpLocalName(e.Name)
+			if e.Type != ftp.EntryTypeFile || !strings.HasPrefix(name, prefix) {
+				continue
+			}
+			files = append(files, ftpFileEntry{Name: name, Size: e.Size, ModTime: e.Time})
+		}
+
+		setContentType(w, "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"servers":   servers,
+			"server":    server,
+			"directory": s.cfg().ftp.dirFtp,
+			"files":     files,
+		})
+	})
+}
+
+// shutdown : same graceful shutdown as SIGINT, answered before it starts
+func (s *Server) shutdown() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger.Println("shutdown requested by " + s.clientIP(r))
+		select {
+		case shutdownRequests <- os.Interrupt:
+		default:
+			// already shutting down
+		}
+		setContentType(w, "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"shuttingDown":    true,
+			"shutdownTimeout": s.cfg().shutdownTimeout.String(),
+		})
+	})
+}
+
+// clearCache : remove the cached pdfs and barcodes of directory, optionally
+// only those starting with ?prefix=, so the next request hits the archive
+func (s *Server) clearCache() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefix := r.URL.Query().Get("prefix")
+		logger.Println("clearCache prefix=" + prefix)
+
+		directory := s.cfg().directory
+		files, err := ioutil.ReadDir(directory)
+		if err != nil {
+			logger.Println("unable to read directory", err)
+			writeError(w, r, http.StatusInternalServerError, "unable to clear cache", "")
+			return
+		}
+
+		cached := map[string]bool{".pdf": true}
+		for _, format := range barcodeFormats {
+			cached[format.ext] = true
+		}
+
+		deleted := 0
+		for _, f := range files {
+			name := f.Name()
+			if !f.Mode().IsRegular() || !cached[filepath.Ext(name)] || !strings.HasPrefix(name, prefix) || strings.HasPrefix(name, tempFilePrefix) {
+				continue
+			}
+			if err := os.Remove(filepath.Join(directory, name)); err != nil {
+				logger.Printf("unable to remove %q %v\n", name, err)
+				continue
+			}
+			os.Remove(filepath.Join(directory, name+fetchedSuffix))
+			deleted++
+		}
+		if s.barcodeCache != nil {
+			deleted += s.barcodeCache.removePrefix(prefix)
+		}
+
+		logger.Printf("clearCache removed %d files\n", deleted)
+		setContentType(w, "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"deleted": deleted})
+	})
+}
+
+// fetchDocument : first of key's documentExtensions variants, the cached ones
+// before asking the archive, in the configured order
+func (s *Server) fetchDocument(ctx context.Context, key string) (currPath string, filename string, source string, err error) {
+	cfg := s.cfg()
+	if _, filename, ok := s.documentPath(cfg.directory, key); ok {
+		currPath, source, err = s.fetchFile(ctx, filename)
+		return currPath, filename, source, err
+	}
+
+	err = errDocumentNotFound
+	for _, ext := range cfg.documentExtensions {
+		filename = key + ext
+		currPath, source, err = s.fetchFile(ctx, filename)
+		if !errors.Is(err, errDocumentNotFound) {
+			return currPath, filename, source, err
+		}
+	}
+	return currPath, filename, source, err
+}
+
+// documentPath : local path and file name of the first of key's
+// documentExtensions variants servable from directory
+func (s *Server) documentPath(directory string, key string) (currPath string, filename string, ok bool) {
+	for _, ext := range s.cfg().documentExtensions {
+		filename = key + ext
+		currPath = directory + "/" + filename
+		if checkServable(directory, currPath) == nil {
+			return currPath, filename, true
+		}
+	}
+	return "", "", false
+}
+
+// isPdf : filename is one of the documentExtensions variants pdfcpu can read
+func isPdf(filename string) bool {
+	return strings.EqualFold(filepath.Ext(filename), ".pdf")
+}
+
+// documentContentType : mime type of filename from documentTypes
+func (s *Server) documentContentType(filename string) string {
+	ext := strings.ToLower(filepath.Ext(filename))
+	if contentType, ok := s.cfg().documentTypes[ext]; ok {
+		return contentType
+	}
+	if contentType := mime.TypeByExtension(ext); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// fetchFile : local path of filename, retrieved from the archive when missing
+// or expired; source is where it came from, sourceLocal, sourceEmbedded,
+// sourceStale or the -backend name
+func (s *Server) fetchFile(ctx context.Context, filename string) (currPath string, source string, err error) {
+	cfg := s.cfg()
+	directory := cfg.directory
+	if directory == "" {
+		return "", "", fmt.Errorf("%w: no directory to store %s", errBackend, filename)
+	}
+	currPath = directory + "/" + filename
+	logger.Println("Document location: " + currPath)
+
+	expired := false
+	info, err := os.Stat(currPath)
+	// a file written by another node may not be visible yet on a shared volume
+	for attempt := 0; os.IsNotExist(err) && attempt < cfg.localRetries; attempt++ {
+		select {
+		case <-time.After(cfg.localRetryDelay):
+		case <-ctx.Done():
+			return currPath, "", ctx.Err()
+		}
+		info, err = os.Stat(currPath)
+	}
+	if err == nil {
+		if err := checkServable(directory, currPath); err != nil {
+			logger.Println("refusing to serve "+currPath, err)
+			return currPath, "", fmt.Errorf("%w: %v", errDocumentNotFound, err)
+		}
+		if cfg.cacheTTL <= 0 || time.Since(fetchedAt(currPath, info)) < cfg.cacheTTL {
+			return currPath, sourceLocal, nil
+		}
+		logger.Println("Pdf expired, refreshing from SRVDATA: " + currPath)
+		expired = true
+	}
+
+	// demo documents baked into the binary
+	if cfg.embeddedMode && !expired {
+		if data, err := embeddedDocs.ReadFile(embeddedDir + "/" + filename); err == nil {
+			logger.Printf("Pdf found in embedded documents: %q\n", filename)
+			_, err := s.storeDocument(directory, filename, bytes.NewReader(data))
+			return currPath, sourceEmbedded, err
+		}
+	}
+
+	if !expired {
+		logger.Println("unable to find pdf. Trying to search on SRVDATA", err)
+	}
+
+	// concurrent requests for the same file share a single ftp fetch,
+	// cancelled once every waiting request gave up
+	flight, release := joinFetch(ctx, filename)
+	defer release()
+	fetchCtx := flight.ctx
+	ch := ftpGroup.DoChan(flight.key, func() (interface{}, error) {
+		defer flight.done(filename)
+
+		// wait for a free ftp slot
+		if s.ftpSlots != nil {
+			select {
+			case s.ftpSlots <- struct{}{}:
+			case <-fetchCtx.Done():
+				return nil, fetchCtx.Err()
+			}
+			defer func() { <-s.ftpSlots }()
+		}
+		return s.backend.retrieve(fetchCtx, directory, filename)
+	})
+
+	select {
+	case res := <-ch:
+		if res.Shared {
+			logger.Printf("shared ftp fetch for: %q\n", filename)
+		}
+		s.metrics.IncFtpFetch(res.Err == nil)
+		if res.Err != nil {
+			atomic.AddInt64(&stats.fallbacksFailed, 1)
+			if expired && cfg.serveStale {
+				logger.Println("archive unavailable, serving stale pdf: "+currPath, res.Err)
+				return currPath, sourceStale, nil
+			}
+		} else {
+			atomic.AddInt64(&stats.fallbacksSucceeded, 1)
+		}
+		return currPath, cfg.backend, res.Err
+	case <-ctx.Done():
+		return currPath, "", ctx.Err()
+	}
+}
+
+// fetchWaiters : requests waiting on each shared fetch
+var fetchWaiters = struct {
+	sync.Mutex
+	fetches map[string]*sharedFetch
+	seq     int64
+}{fetches: make(map[string]*sharedFetch)}
+
+// sharedFetch : one flight of ftpGroup, keyed by filename and a sequence
+// number so a request arriving after a cancellation starts a new flight
+// instead of joining the cancelled one
+type sharedFetch struct {
+	key     string
+	ctx     context.Context
+	cancel  context.CancelFunc
+	waiters int
+}
+
+// joinFetch : flight of filename, carrying the first request's trace;
+// release cancels it when the last waiter leaves
+func joinFetch(ctx context.Context, filename string) (*sharedFetch, func()) {
+	fetchWaiters.Lock()
+	defer fetchWaiters.Unlock()
+
+	f, ok := fetchWaiters.fetches[filename]
+	if !ok || f.ctx.Err() != nil {
+		fetchWaiters.seq++
+		fetchCtx := trace.ContextWithSpanContext(context.Background(), trace.SpanContextFromContext(ctx))
+		fetchCtx, cancel := context.WithCancel(fetchCtx)
+		f = &sharedFetch{key: filename + "#" + strconv.FormatInt(fetchWaiters.seq, 10), ctx: fetchCtx, cancel: cancel}
+		fetchWaiters.fetches[filename] = f
+	}
+	f.waiters++
+
+	return f, func() {
+		fetchWaiters.Lock()
+		defer fetchWaiters.Unlock()
+		f.waiters--
+		if f.waiters == 0 {
+			f.cancel()
+		}
+	}
+}
+
+// done : the flight finished, later requests start their own
+func (f *sharedFetch) done(filename string) {
+	fetchWaiters.Lock()
+	defer fetchWaiters.Unlock()
+	if fetchWaiters.fetches[filename] == f {
+		delete(fetchWaiters.fetches, filename)
+	}
+}
+
+// validKey : key usable as a file name; separators and parent references
+// would let a request read or write outside directory, control characters
+// (CR, LF, NUL...) would forge log lines
+func validKey(key string) bool {
+	if key == "" || strings.ContainsAny(key, "/\\") || strings.Contains(key, "..") {
+		return false
+	}
+	return strings.IndexFunc(key, unicode.IsControl) < 0
+}
+
+// checkServable : path must resolve, symlinks included, to a regular file
+// inside directory; pipes, devices and directories named like a key would
+// block or misbehave in http.ServeFile
+func checkServable(directory string, path string) error {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return err
+	}
+	root, err := filepath.EvalSymlinks(directory)
+	if err != nil {
+		return err
+	}
+	if rel, err := filepath.Rel(root, resolved); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%s resolves outside of %s", path, directory)
+	}
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file (%s)", path, info.Mode().Type())
+	}
+	return nil
+}
+
+// writeFetchError : status matching a fetchPdf error, checked from the most
+// specific cause
+func writeFetchError(w http.ResponseWriter, r *http.Request, key string, err error) {
+	switch {
+	case errors.Is(err, errFtpTimeout):
+		logger.Printf("ftp retrieval timed out for key %q %v\n", key, err)
+		writeError(w, r, http.StatusGatewayTimeout, "archive retrieval timed out", "")
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		logger.Printf("gave up waiting for ftp retrieval of key %q %v\n", key, err)
+		writeError(w, r, http.StatusServiceUnavailable, "archive retrieval cancelled", "")
+	case errors.Is(err, errDocumentNotFound):
+		logger.Println("unable to find pdf", err)
+		writeError(w, r, http.StatusNotFound, "attestation not found", pdfNotFoundPages[preferredLanguage(r)])
+	case errors.Is(err, errPdfTooLarge) || errors.Is(err, errBackend):
+		logger.Printf("unable to retrieve pdf for key %q %v\n", key, err)
+		writeError(w, r, http.StatusBadGateway, "unable to retrieve attestation from archive", "")
+	default:
+		logger.Println("unable to find pdf", err)
+		writeError(w, r, http.StatusNotFound, "attestation not found", pdfNotFoundPages[preferredLanguage(r)])
+	}
+}
+
+// existsPdf : 200 when the attestation is available locally or on the
+// archive, 404 otherwise, without transferring it
+func (s *Server) existsPdf() http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := s.cfg()
+
+		logger.Println("existsPdf")
+
+		key := r.URL.Query().Get("key")
+		if key == "" {
+			writeError(w, r, http.StatusBadRequest, "missing key parameter", "")
+			return
+		}
+		if !validKey(key) {
+			writeError(w, r, http.StatusBadRequest, "invalid key parameter", "")
+			return
+		}
+
+		key, ok := s.resolveKey(w, r, key)
+		if !ok {
+			return
+		}
+
+		// the same variants, in the same order, as /attestation
+		source := "local"
+		if _, _, ok := s.documentPath(cfg.directory, key); !ok {
+			source = "archive"
+			for _, ext := range cfg.documentExtensions {
+				if _, err := embeddedDocs.Open(embeddedDir + "/" + key + ext); cfg.embeddedMode && err == nil {
+					source = "embedded"
+					break
+				}
+			}
+		}
+
+		if source == "archive" {
+			err := errDocumentNotFound
+			for _, ext := range cfg.documentExtensions {
+				if err = s.backend.stat(r.Context(), key+ext); !errors.Is(err, errDocumentNotFound) {
+					break
+				}
+			}
+			if errors.Is(err, errDocumentNotFound) {
+				writeError(w, r, http.StatusNotFound, "attestation not found", "")
+				return
+			}
+			if errors.Is(err, errFtpTimeout) {
+				logger.Printf("ftp stat timed out for key %q %v\n", key, err)
+				writeError(w, r, http.StatusGatewayTimeout, "archive check timed out", "")
+				return
+			}
+			if err != nil {
+				logger.Printf("unable to check archive for key %q %v\n", key, err)
+				writeError(w, r, http.StatusBadGateway, "unable to check archive", "")
+				return
+			}
+		}
+
+		setContentType(w, "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"key":    key,
+			"exists": true,
+			"source": source,
+		})
+	})
+}
+
+// renderBarcode : default png label of key, as /sampleIdToBarCode draws it
+// without options
+func (s *Server) renderBarcode(ctx context.Context, key string) ([]byte, error) {
+	release, err := s.acquireBarcodeWorker(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	bc, err := code128.Encode(key)
+	if err != nil {
+		return nil, err
+	}
+	margin := quietZoneModules * max(defaultBarcodeSize/bc.Bounds().Dx(), 1)
+	img, err := scaleBarcode(bc, defaultBarcodeSize, defaultBarcodeSize, margin)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := s.pngEncoder.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// scaleBarcode : bc drawn on width x height pixels inside a white margin
+func scaleBarcode(bc barcode.Barcode, width int, height int, margin int) (image.Image, error) {
+	scaled, err := barcode.Scale(bc, width, height)
+	if err != nil {
+		return nil, err
+	}
+	return addMargin(scaled, margin), nil
+}
+
+// bundleAttestation : multipart/mixed with the document and the png label of ?key=;
+// when one of them fails the other is sent with a text/plain warning part
+func (s *Server) bundleAttestation() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		logger.Println("bundleAttestation")
+
+		key := r.URL.Query().Get("key")
+		if key == "" {
+			writeError(w, r, http.StatusBadRequest, "missing key parameter", "")
+			return
+		}
+		if !validKey(key) {
+			writeError(w, r, http.StatusBadRequest, "invalid key parameter", "")
+			return
+		}
+
+		key, ok := s.resolveKey(w, r, key)
+		if !ok {
+			return
+		}
+
+		// the document /attestation would serve, as it would serve it
+		var content io.ReadSeekCloser
+		currPath, filename, source, pdfErr := s.fetchDocument(r.Context(), key)
+		if pdfErr == nil {
+			content, _, pdfErr = s.openDocument(currPath, filename)
+		}
+		if pdfErr == nil {
+			defer content.Close()
+		}
+		label, labelErr := s.renderBarcode(r.Context(), key)
+		if pdfErr != nil && labelErr != nil {
+			logger.Printf("unable to render barcode for key %q %v\n", key, labelErr)
+			writeFetchError(w, r, key, pdfErr)
+			return
+		}
+
+		// parts are streamed, the document isn't loaded in memory
+		mw := multipart.NewWriter(w)
+		createPart := func(contentType string, filename string) (io.Writer, error) {
+			header := textproto.MIMEHeader{}
+			header.Set("Content-Type", contentType)
+			header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+			return mw.CreatePart(header)
+		}
+		addWarning := func(message string) {
+			header := textproto.MIMEHeader{}
+			header.Set("Content-Type", "text/plain; charset=utf-8")
+			header.Set("Content-Disposition", "inline")
+			part, _ := mw.CreatePart(header)
+			io.WriteString(part, message)
+		}
+
+		if pdfErr != nil || labelErr != nil {
+			w.Header().Set("Warning", `199 - "incomplete bundle"`)
+		}
+		if source == sourceStale {
+			w.Header().Add("Warning", `110 - "Response is Stale"`)
+		}
+		w.Header().Set("Content-Type", mime.FormatMediaType("multipart/mixed", map[string]string{"boundary": mw.Boundary()}))
+
+		var size int64
+		if pdfErr != nil {
+			logger.Printf("unable to fetch document for bundle of key %q %v\n", key, pdfErr)
+			if errors.Is(pdfErr, errDocumentNotFound) {
+				addWarning("attestation not found")
+			} else {
+				addWarning("attestation unavailable, retry later")
+			}
+		} else {
+			part, err := createPart(s.documentContentType(filename), filename)
+			if err == nil {
+				size, err = io.Copy(part, content)
+			}
+			if err != nil {
+				// headers are gone, the client sees a truncated body
+				logger.Printf("WARN bundle %q truncated after %d bytes (source %s): %v\n", key, size, source, err)
+				return
+			}
+		}
+		if labelErr != nil {
+			logger.Printf("unable to render barcode for key %q %v\n", key, labelErr)
+			if errors.Is(labelErr, errBarcodeQueueFull) || errors.Is(labelErr, context.Canceled) || errors.Is(labelErr, context.DeadlineExceeded) {
+				addWarning("barcode unavailable, retry later")
+			} else {
+				addWarning("key can't be encoded as code128")
+			}
+		} else if part, err := createPart("image/png", key+".png"); err == nil {
+			part.Write(label)
+		}
+		mw.Close()
+
+		if s.auditLog != nil && pdfErr == nil && r.Method == http.MethodGet {
+			s.auditLog.record(r, s.clientIP(r), key, source, size)
+		}
+	})
+}
+
+// lookupAttestation : keys starting with ?prefix= in directory, and on the
+// archive with ?archive=true; one match is served directly with ?serve=true,
+// several answer 300 Multiple Choices
+func (s *Server) lookupAttestation() http.Handler {
+	serve := s.attestationPdf()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := s.cfg()
+
+		logger.Println("lookupAttestation")
+
+		query := r.URL.Query()
+		prefix := query.Get("prefix")
+		if len(prefix) < minLookupPrefix {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("prefix must be at least %d characters", minLookupPrefix), "")
+			return
+		}
+
+		found := make(map[string]bool)
+		files, err := ioutil.ReadDir(cfg.directory)
+		if err != nil && cfg.directory != "" {
+			logger.Println("unable to read directory", err)
+		}
+		for _, f := range files {
+			name := f.Name()
+			ext := filepath.Ext(name)
+			if f.Mode().IsRegular() && strings.HasPrefix(name, prefix) && slices.Contains(cfg.documentExtensions, ext) && !strings.HasPrefix(name, tempFilePrefix) {
+				found[strings.TrimSuffix(name, ext)] = true
+			}
+		}
+
+		if query.Get("archive") == "true" {
+			keys, err := s.backend.list(r.Context(), prefix)
+			if err != nil {
+				writeFetchError(w, r, prefix, err)
+				return
+			}
+			for _, key := range keys {
+				found[key] = true
+			}
+		}
+
+		keys := make([]string, 0, len(found))
+		for key := range found {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		switch {
+		case len(keys) == 0:
+			writeError(w, r, http.StatusNotFound, "no attestation starts with "+prefix, pdfNotFoundPages[preferredLanguage(r)])
+			return
+		case len(keys) == 1 && query.Get("serve") == "true":
+			values := url.Values{"key": {keys[0]}}
+			if query.Get("download") != "" {
+				values.Set("download", query.Get("download"))
+			}
+			r2 := r.Clone(r.Context())
+			r2.URL.RawQuery = values.Encode()
+			serve.ServeHTTP(w, r2)
+			return
+		}
+
+		truncated := len(keys) > maxLookupMatches
+		if truncated {
+			keys = keys[:maxLookupMatches]
+		}
+		status := http.StatusOK
+		if len(keys) > 1 {
+			status = http.StatusMultipleChoices
+		}
+		setContentType(w, "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"prefix":    prefix,
+			"keys":      keys,
+			"truncated": truncated,
+		})
+	})
+}
+
+// galleryImage : one <key>_<n> photo of an attestation
+type galleryImage struct {
+	Name        string       `json:"name"`
+	ContentType string       `json:"contentType"`
+	Data        string       `json:"data"`
+	Src         template.URL `json:"-"`
+}
+
+// galleryImages : the <key>_<n>.png/.jpg/.gif photos of key in directory,
+// ordered by n
+func galleryImages(directory string, key string) ([]galleryImage, error) {
+	files, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+
+	type indexed struct {
+		n    int
+		name string
+		ext  string
+	}
+	var found []indexed
+	for _, f := range files {
+		name := f.Name()
+		ext := filepath.Ext(name)
+		n, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSuffix(name, ext), key+"_"))
+		if err != nil || n < 0 || !strings.HasPrefix(name, key+"_") || strings.HasPrefix(name, tempFilePrefix) {
+			continue
+		}
+		if ext != ".png" && ext != ".jpg" && ext != ".gif" {
+			continue
+		}
+		found = append(found, indexed{n: n, name: name, ext: ext})
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].n < found[j].n })
+	if len(found) > maxGalleryImages {
+		found = found[:maxGalleryImages]
+	}
+
+	images := []galleryImage{}
+	for _, f := range found {
+		currPath := directory + "/" + f.name
+		if err := checkServable(directory, currPath); err != nil {
+			logger.Println("refusing to serve "+currPath, err)
+			continue
+		}
+		data, err := ioutil.ReadFile(currPath)
+		if err != nil {
+			logger.Println("unable to read image "+currPath, err)
+			continue
+		}
+		contentType := mime.TypeByExtension(f.ext)
+		encoded := base64.StdEncoding.EncodeToString(data)
+		images = append(images, galleryImage{
+			Name:        f.name,
+			ContentType: contentType,
+			Data:        encoded,
+			Src:         template.URL("data:" + contentType + ";base64," + encoded),
+		})
+	}
+	return images, nil
+}
+
+// imageGallery : photos of ?key= as an html page, or base64 json with
+// ?format=json
+func (s *Server) imageGallery() http.Handler {
+	gallery := template.Must(template.New("gallery").Parse(GalleryTemplate))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		logger.Println("imageGallery")
+
+		key := r.URL.Query().Get("key")
+		if key == "" {
+			writeError(w, r, http.StatusBadRequest, "missing key parameter", "")
+			return
+		}
+		if !validKey(key) {
+			writeError(w, r, http.StatusBadRequest, "invalid key parameter", "")
+			return
+		}
+
+		images, err := galleryImages(s.cfg().directory, key)
+		if err != nil {
+			logger.Println("unable to read directory", err)
+			writeError(w, r, http.StatusInternalServerError, "unable to list images", "")
+			return
+		}
+		if len(images) == 0 {
+			logger.Printf("no image found for key %q\n", key)
+			writeError(w, r, http.StatusNotFound, "images not found", imageNotFoundPages[preferredLanguage(r)])
+			return
+		}
+
+		if r.URL.Query().Get("format") == "json" {
+			setContentType(w, "application/json")
+			json.NewEncoder(w).Encode(images)
+			return
+		}
+
+		var page bytes.Buffer
+		if err := gallery.Execute(&page, map[string]interface{}{"Images": images}); err != nil {
+			logger.Println("unable to execute template.", err)
+			writeError(w, r, http.StatusInternalServerError, "unable to render images", "")
+			return
+		}
+		setContentType(w, "text/html")
+		w.Write(page.Bytes())
+	})
+}
+
+// auditEntry : one delivered attestation; Hash covers the entry and Prev,
+// the Hash of the entry before, so a removed or edited line breaks the chain
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"requestId"`
+	Key       string    `json:"key"`
+	ClientIP  string    `json:"clientIp"`
+	Source    string    `json:"source"`
+	Bytes     int64     `json:"bytes"`
+	Prev      string    `json:"prev"`
+	Hash      string    `json:"hash,omitempty"`
+}
+
+// auditWriter : serialized, hash-chained json lines, synced after each entry
+type auditWriter struct {
+	sync.Mutex
+	w    io.Writer
+	sync func() error
+	prev string
+}
+
+// openAuditLog : append to the file dest, or send to syslog for "syslog"
+// (local socket) and "syslog://host:port" (udp)
+func openAuditLog(dest string) (*auditWriter, error) {
+	if dest == "syslog" || strings.HasPrefix(dest, "syslog://") {
+		var conn net.Conn
+		var err error
+		if dest == "syslog" {
+			conn, err = net.Dial("unixgram", "/dev/log")
+		} else {
+			conn, err = net.Dial("udp", strings.TrimPrefix(dest, "syslog://"))
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &auditWriter{w: &syslogWriter{conn: conn}}, nil
+	}
+
+	f, err := os.OpenFile(dest, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	prev, err := lastAuditHash(dest)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &auditWriter{w: f, sync: f.Sync, prev: prev}, nil
+}
+
+// lastAuditHash : Hash of the last entry of an existing audit file, so the
+// chain continues across restarts
+func lastAuditHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	// entries are short, the tail holds the last one
+	offset := max(info.Size()-64<<10, 0)
+	tail := make([]byte, info.Size()-offset)
+	if _, err := f.ReadAt(tail, offset); err != nil {
+		return "", err
+	}
+	lines := strings.Split(strings.TrimRight(string(tail), "\n"), "\n")
+	var last auditEntry
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &last); err != nil {
+		return "", nil
+	}
+	return last.Hash, nil
+}
+
+// record : append the entry of a document delivered to client
+func (a *auditWriter) record(r *http.Request, client string, key string, source string, size int64) {
+	requestID, _ := r.Context().Value(requestIDKey).(string)
+	entry := auditEntry{
+		Time:      time.Now().UTC(),
+		RequestID: requestID,
+		Key:       key,
+		ClientIP:  client,
+		Source:    source,
+		Bytes:     size,
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	entry.Prev = a.prev
+	unsigned, _ := json.Marshal(entry)
+	sum := sha256.Sum256(unsigned)
+	entry.Hash = hex.EncodeToString(sum[:])
+	line, _ := json.Marshal(entry)
+
+	if _, err := a.w.Write(append(line, '\n')); err != nil {
+		logger.Printf("unable to write audit entry for key %q %v\n", key, err)
+		return
+	}
+	if a.sync != nil {
+		if err := a.sync(); err != nil {
+			logger.Println("unable to sync audit log", err)
+		}
+	}
+	a.prev = entry.Hash
+}
+
+// syslogWriter : one RFC 3164 message per write, facility authpriv
+type syslogWriter struct {
+	conn net.Conn
+}
+
+func (s *syslogWriter) Write(b []byte) (int, error) {
+	const priority = 10*8 + 6 // authpriv.info
+	hostname, _ := os.Hostname()
+	msg := fmt.Sprintf("<%d>%s %s %s[%d]: %s", priority, time.Now().Format(time.Stamp), hostname, serviceName, os.Getpid(), strings.TrimRight(string(b), "\n"))
+	if _, err := s.conn.Write([]byte(msg)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// stampPdf : -watermark and the delivery time on every page of the pdf in rs
+func (s *Server) stampPdf(rs io.ReadSeeker, delivered time.Time) ([]byte, error) {
+	cfg := s.cfg()
+	text := cfg.watermark + "\n" + delivered.Format("2006-01-02 15:04:05 MST")
+	wm, err := api.TextWatermark(text, cfg.watermarkStyle, true, false, types.POINTS)
+	if err != nil {
+		return nil, err
+	}
+	var stamped bytes.Buffer
+	if err := api.AddWatermarks(rs, &stamped, nil, wm, nil); err != nil {
+		return nil, err
+	}
+	return stamped.Bytes(), nil
+}
+
+// mergePdf : single pdf made of the attestations listed in ?keys=A,B,C,
+// a missing one fails the request unless ?missing=skip
+func (s *Server) mergePdf() http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		logger.Println("mergePdf")
+
+		var keys []string
+		for _, key := range strings.Split(r.URL.Query().Get("keys"), ",") {
+			if key = strings.Trim(key, " "); key != "" {
+				if !validKey(key) {
+					writeError(w, r, http.StatusBadRequest, "invalid key parameter: "+key, "")
+					return
+				}
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) == 0 {
+			writeError(w, r, http.StatusBadRequest, "missing keys parameter", "")
+			return
+		}
+		if len(keys) > maxMergeKeys {
+			writeError(w, r, http.StatusBadRequest, fmt.Sprintf("at most %d keys can be merged", maxMergeKeys), "")
+			return
+		}
+
+		skipMissing := false
+		switch r.URL.Query().Get("missing") {
+		case "", "fail":
+		case "skip":
+			skipMissing = true
+		default:
+			writeError(w, r, http.StatusBadRequest, "invalid missing parameter", "")
+			return
+		}
+
+		var docs []io.ReadSeeker
+		var missing []string
+		for _, key := range keys {
+			currPath, filename, _, err := s.fetchDocument(r.Context(), key)
+			if err == nil && !isPdf(filename) {
+				writeError(w, r, http.StatusUnsupportedMediaType, "attestation "+key+" is not a pdf", "")
+				return
+			}
+			if err == nil {
+				var data []byte
+				data, err = ioutil.ReadFile(currPath)
+				docs = append(docs, bytes.NewReader(data))
+			}
+			if err == nil {
+				continue
+			}
+
+			logger.Printf("unable to retrieve pdf for key %q %v\n", key, err)
+			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+				writeError(w, r, http.StatusServiceUnavailable, "archive retrieval cancelled", "")
+				return
+			}
+			if !skipMissing {
+				writeError(w, r, http.StatusNotFound, "attestation "+key+" not found", pdfNotFoundPages[preferredLanguage(r)])
+				return
+			}
+			missing = append(missing, key)
+		}
+		if len(docs) == 0 {
+			writeError(w, r, http.StatusNotFound, "attestations not found", pdfNotFoundPages[preferredLanguage(r)])
+			return
+		}
+
+		var merged bytes.Buffer
+		if err := api.MergeRaw(docs, &merged, false, nil); err != nil {
+			logger.Println("unable to merge pdfs", err)
+			writeError(w, r, http.StatusInternalServerError, "unable to merge attestations", "")
+			return
+		}
+		if s.cfg().watermark != "" {
+			stamped, err := s.stampPdf(bytes.NewReader(merged.Bytes()), time.Now())
+			if err != nil {
+				logger.Println("unable to stamp merged pdf", err)
+				writeError(w, r, http.StatusInternalServerError, "unable to stamp attestations", "")
+				return
+			}
+			merged.Reset()
+			merged.Write(stamped)
+			w.Header().Set("Cache-Control", "no-store")
+		}
+
+		if len(missing) > 0 {
+			w.Header().Set("Warning", fmt.Sprintf(`199 - "missing attestations: %s"`, strings.Join(missing, ",")))
+		}
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": "attestations.pdf"}))
+		setContentType(w, "application/pdf")
+		w.Write(merged.Bytes())
+	})
+}
+
+func (s *Server) previewPdf() http.Handler {
+
+	// rendered previews keyed by pdf etag and width
+	var mu sync.Mutex
+	cache := make(map[string][]byte)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		logger.Println("previewPdf")
+
+		// get search key
+		keys, ok := r.URL.Query()["key"]
+		if !ok || len(keys[0]) < 1 {
+			writeError(w, r, http.StatusBadRequest, "missing key parameter", "")
+			return
+		}
+		key := keys[0]
+		if !validKey(key) {
+			writeError(w, r, http.StatusBadRequest, "invalid key parameter", "")
+			return
+		}
+
+		logger.Printf("Url Param 'key' is: %q\n", key)
+
+		// optional width in pixels (default 200)
+		width := 200
+		if v := r.URL.Query().Get("width"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxPreviewWidth {
+				writeError(w, r, http.StatusBadRequest, "invalid width parameter", "")
+				return
+			}
+			width = n
+		}
+
+		currPath, filename, source, err := s.fetchDocument(r.Context(), key)
+		if err != nil {
+			writeFetchError(w, r, key, err)
+			return
+		}
+		if !isPdf(filename) {
+			writeError(w, r, http.StatusUnsupportedMediaType, "attestation is not a pdf", "")
+			return
+		}
+
+		info, err := os.Stat(currPath)
+		if err != nil {
+			logger.Println("unable to stat pdf", err)
+			writeError(w, r, http.StatusNotFound, "attestation not found", pdfNotFoundPages[preferredLanguage(r)])
+			return
+		}
+		etag := pdfETag(info)
+		cacheKey := etag + "/" + strconv.Itoa(width)
+
+		if source == sourceStale {
+			w.Header().Set("Warning", `110 - "Response is Stale"`)
+		}
+
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		mu.Lock()
+		img, ok := cache[cacheKey]
+		mu.Unlock()
+
+		if !ok {
+			img, err = s.renderFirstPage(currPath, width)
+			if err != nil {
+				logger.Println("unable to render pdf preview", err)
+				writeError(w, r, http.StatusServiceUnavailable, "unable to render preview", "")
+				return
+			}
+			mu.Lock()
+			if len(cache) >= maxPreviewCache {
+				cache = make(map[string][]byte)
+			}
+			cache[cacheKey] = img
+			mu.Unlock()
+		}
+
+		setContentType(w, "image/png")
+		w.Write(img)
+	})
+}
+
+// pdfETag : weak validator built from the pdf size and modification time
+func pdfETag(info os.FileInfo) string {
+	return fmt.Sprintf("\"%x-%x\"", info.Size(), info.ModTime().UnixNano())
+}
+
+// renderFirstPage : rasterize the first page of a pdf as png at the given width
+func (s *Server) renderFirstPage(currPath string, width int) ([]byte, error) {
+
+	pdfiumOnce.Do(func() {
+		// pure Go (webassembly) build of pdfium, no cgo required
+		pdfiumPool, pdfiumErr = webassembly.Init(webassembly.Config{MinIdle: 1, MaxIdle: 1, MaxTotal: 1})
+	})
+	if pdfiumErr != nil {
+		return nil, pdfiumErr
+	}
+
+	instance, err := pdfiumPool.GetInstance(30 * time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer instance.Close()
+
+	pdfBytes, err := ioutil.ReadFile(currPath)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := instance.OpenDocument(&requests.OpenDocument{File: &pdfBytes})
+	if err != nil {
+		return nil, err
+	}
+	defer instance.FPDF_CloseDocument(&requests.FPDF_CloseDocument{Document: doc.Document})
+
+	page, err := instance.RenderPageInPixels(&requests.RenderPageInPixels{
+		Page:  requests.Page{ByIndex: &requests.PageByIndex{Document: doc.Document, Index: 0}},
+		Width: width,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer page.Cleanup()
+
+	buffer := new(bytes.Buffer)
+	if err := s.pngEncoder.Encode(buffer, page.Result.Image); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// ftpDialOptions : dial options of one ftp connection from the -ftp* flags;
+// the client only speaks passive mode, -ftpDisableEPSV forces PASV
+func ftpDialOptions(cfg *Config) []ftp.DialOption {
+	options := []ftp.DialOption{
+		ftp.DialWithTimeout(cfg.ftpDialTimeout),
+		ftp.DialWithDisabledEPSV(cfg.ftpDisableEPSV),
+	}
+
+	dataTimeout := cfg.ftpDataTimeout
+	if dataTimeout <= 0 {
+		dataTimeout = cfg.ftpOpTimeout
+	}
+	if cfg.ftpOpTimeout > 0 || dataTimeout > 0 {
+		// the first dial is the control connection, the next ones carry data
+		control := true
+		options = append(options, ftp.DialWithDialFunc(func(network, address string) (net.Conn, error) {
+			timeout := dataTimeout
+			if control {
+				control, timeout = false, cfg.ftpOpTimeout
+			}
+			conn, err := net.DialTimeout(network, address, cfg.ftpDialTimeout)
+			if err != nil || timeout <= 0 {
+				return conn, err
+			}
+			return &deadlineConn{Conn: conn, timeout: timeout}, nil
+		}))
+	}
+	return options
+}
+
+// ftpConnect : dial, login and move to the archive directory
+func (s *Server) ftpConnect(ctx context.Context, server string) (*ftp.ServerConn, error) {
+
+	options := ftpDialOptions(s.cfg())
+
+	_, span := tracer.Start(ctx, "ftp.dial", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("ftp.server", server)))
+	c, err := ftp.Dial(ftpAddress(server), options...)
+	endSpan(span, err)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", errFtpDial, server, err)
+	}
+
+	_, span = tracer.Start(ctx, "ftp.login", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("ftp.server", server)))
+	account := s.cfg().ftp
+	err = c.Login(account.userFtp, account.pwdFtp)
+	endSpan(span, err)
+	if err != nil {
+		c.Quit()
+		return nil, fmt.Errorf("%w: %s: %w", errFtpLogin, server, err)
+	}
+
+	if account.dirFtp != "" {
+		if err := c.ChangeDir(account.dirFtp); err != nil {
+			logger.Println("unable to change to ftp directory " + account.dirFtp + " on " + server)
+			c.Quit()
+			return nil, fmt.Errorf("%w: ftp directory %s: %v", errBackend, account.dirFtp, err)
+		}
+	}
+
+	return c, nil
+}
+
+// deadlineConn : net.Conn pushing its deadline back before every read or write,
+// so each ftp operation (login, retr, every chunk of the copy) is bounded
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	c.Conn.SetDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(b)
+}
+
+// endSpan : record the outcome of an operation and end its span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.SetAttributes(attribute.String("outcome", "error"))
+	} else {
+		span.SetAttributes(attribute.String("outcome", "ok"))
+	}
+	span.End()
+}
+
+// isTimeout : err comes from an expired network deadline
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// ftpAddress : server as host:port, port 21 unless given
+func ftpAddress(server string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(server, "21")
+}
+
+// ftpServers : servers listed in -srvFtp, in failover order
+func (s *Server) ftpServers() []string {
+	var servers []string
+	for _, srv := range strings.Split(s.cfg().ftp.srvFtp, ",") {
+		if srv = strings.TrimSpace(srv); srv != "" {
+			servers = append(servers, srv)
+		}
+	}
+	return servers
+}
+
+// ftpHealth : servers temporarily skipped after a connection failure
+var ftpHealth = struct {
+	sync.Mutex
+	skipUntil map[string]time.Time
+}{skipUntil: make(map[string]time.Time)}
+
+func (s *Server) markFtpFailure(server string) {
+	ftpHealth.Lock()
+	ftpHealth.skipUntil[server] = time.Now().Add(s.cfg().ftpCooldown)
+	ftpHealth.Unlock()
+}
+
+func ftpAvailable(server string) bool {
+	ftpHealth.Lock()
+	defer ftpHealth.Unlock()
+	return time.Now().After(ftpHealth.skipUntil[server])
+}
+
+func (s *Server) retrieveFromSRVDATA(ctx context.Context, directory string, filename string) (file *os.File, err error) {
+
+	for _, srv := range s.ftpCandidates() {
+		if ctx.Err() != nil {
+			return file, ctx.Err()
+		}
+		file, err = s.retrieveFromServer(ctx, srv, directory, filename)
+		if err == nil {
+			logger.Printf("retrieved %q from %s\n", filename, srv)
+			return file, nil
+		}
+		if errors.Is(err, errPdfTooLarge) {
+			return file, err
+		}
+		logger.Printf("unable to retrieve %q from %s %v\n", filename, srv, err)
+	}
+
+	return file, err
+}
+
+// ftpCandidates : servers to try in failover order, skipping the ones
+// cooling down unless all of them are
+func (s *Server) ftpCandidates() []string {
+	servers := s.ftpServers()
+	var candidates []string
+	for _, srv := range servers {
+		if ftpAvailable(srv) {
+			candidates = append(candidates, srv)
+		}
+	}
+	if len(candidates) == 0 {
+		return servers
+	}
+	return candidates
+}
+
+// listOnSRVDATA : keys of the pdfs starting with prefix on the first
+// reachable ftp server
+func (s *Server) listOnSRVDATA(ctx context.Context, prefix string) (keys []string, err error) {
+
+	err = fmt.Errorf("%w: no ftp server configured", errBackend)
+	for _, srv := range s.ftpCandidates() {
+		var c *ftp.ServerConn
+		c, err = s.getFtpConn(ctx, srv)
+		if err != nil {
+			s.markFtpFailure(srv)
+			continue
+		}
+		var names []string
+		names, err = c.NameList("")
+		s.releaseFtpConn(srv, c, err)
+		if err != nil {
+			logger.Println("unable to list files on "+srv, err)
+			continue
+		}
+		seen := make(map[string]bool)
+		for _, name := range names {
+			key, ok := s.ftpKey(strings.TrimSuffix(path.Base(s.ftpLocalName(name)), ".gz"), ".pdf")
+			if ok && strings.HasPrefix(key, prefix) && !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+		return keys, nil
+	}
+
+	return nil, err
+}
+
+// statOnSRVDATA : nil when filename is on the ftp archive, checked with SIZE
+// instead of a transfer
+func (s *Server) statOnSRVDATA(ctx context.Context, filename string) (err error) {
+
+	err = fmt.Errorf("%w: no ftp server configured", errBackend)
+	for _, srv := range s.ftpCandidates() {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var c *ftp.ServerConn
+		c, err = s.getFtpConn(ctx, srv)
+		if err != nil {
+			s.markFtpFailure(srv)
+			continue
+		}
+		remoteName := s.ftpRemoteName(filename)
+		_, err = c.FileSize(s.ftpName(remoteName))
+		if err != nil && ftpNotFound(err) {
+			_, err = c.FileSize(s.ftpName(remoteName + ".gz"))
+		}
+		if err == nil {
+			s.putFtpConn(srv, c)
+			return nil
+		}
+		if ftpNotFound(err) {
+			s.putFtpConn(srv, c)
+			return fmt.Errorf("%w: %v", errDocumentNotFound, err)
+		}
+		if isTimeout(err) {
+			s.markFtpFailure(srv)
+			err = fmt.Errorf("%w: %w", errFtpTimeout, err)
+		}
+		s.releaseFtpConn(srv, c, err)
+		logger.Printf("unable to stat %q on %s %v\n", filename, srv, err)
+	}
+
+	return err
+}
+
+// ftpNotFound : 550 reply, the file doesn't exist on the server
+func ftpNotFound(err error) bool {
+	var protoErr *textproto.Error
+	return errors.As(err, &protoErr) && protoErr.Code == ftp.StatusFileUnavailable
+}
+
+// ftpName : name in the -ftpCharset of the server, unchanged for utf-8
+// or when the server charset can't represent it
+func (s *Server) ftpName(name string) string {
+	cfg := s.cfg()
+	if cfg.ftpEncoding == nil {
+		return name
+	}
+	encoded, err := cfg.ftpEncoding.NewEncoder().String(name)
+	if err != nil {
+		s.debugln("unable to encode ftp name "+name, err)
+		return name
+	}
+	return encoded
+}
+
+// ftpNameData : fields of the -ftpNameTemplate
+type ftpNameData struct {
+	Key string // attestation key, e.g. WA46668
+	Ext string // extension with its dot, e.g. .pdf
+}
+
+// parseFtpNameTemplate : -ftpNameTemplate, rejected when it doesn't give
+// distinct plain file names for distinct keys
+func parseFtpNameTemplate(text string) (*texttemplate.Template, error) {
+	tmpl, err := texttemplate.New("ftpName").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	names := make(map[string]bool)
+	for _, key := range []string{"WA46668", "SCC1165613"} {
+		var b strings.Builder
+		if err := tmpl.Execute(&b, ftpNameData{Key: key, Ext: ".pdf"}); err != nil {
+			return nil, err
+		}
+		name := b.String()
+		if name == "" || strings.ContainsAny(name, "/\\\x00") || name == "." || name == ".." {
+			return nil, fmt.Errorf("%q is not a file name", name)
+		}
+		if names[name] {
+			return nil, errors.New("the name doesn't depend on {{.Key}}")
+		}
+		names[name] = true
+	}
+	return tmpl, nil
+}
+
+// ftpRemoteName : name of the local filename on the ftp archive, filename
+// itself without -ftpNameTemplate
+func (s *Server) ftpRemoteName(filename string) string {
+	cfg := s.cfg()
+	if cfg.ftpNameTmpl == nil {
+		return filename
+	}
+	ext := path.Ext(filename)
+	var b strings.Builder
+	if err := cfg.ftpNameTmpl.Execute(&b, ftpNameData{Key: strings.TrimSuffix(filename, ext), Ext: ext}); err != nil {
+		logger.Printf("unable to apply ftp name template to %q %v\n", filename, err)
+		return filename
+	}
+	return b.String()
+}
+
+// ftpKey : key of a name listed on the ftp archive, the reverse of
+// ftpRemoteName for files with extension ext
+func (s *Server) ftpKey(name string, ext string) (string, bool) {
+	cfg := s.cfg()
+	if cfg.ftpNameTmpl == nil {
+		if !strings.HasSuffix(name, ext) || name == ext {
+			return "", false
+		}
+		return strings.TrimSuffix(name, ext), true
+	}
+	// the template is rendered around a marker key, what surrounds the
+	// marker is stripped from the listed name
+	const marker = "\x00"
+	var b strings.Builder
+	if err := cfg.ftpNameTmpl.Execute(&b, ftpNameData{Key: marker, Ext: ext}); err != nil {
+		return "", false
+	}
+	before, after, found := strings.Cut(b.String(), marker)
+	if !found || strings.Contains(after, marker) || len(name) <= len(before)+len(after) ||
+		!strings.HasPrefix(name, before) || !strings.HasSuffix(name, after) {
+		return "", false
+	}
+	return name[len(before) : len(name)-len(after)], true
+}
+
+// ftpLocalName : utf-8 name of a name listed by the server
+func (s *Server) ftpLocalName(name string) string {
+	cfg := s.cfg()
+	if cfg.ftpEncoding == nil {
+		return name
+	}
+	decoded, err := cfg.ftpEncoding.NewDecoder().String(name)
+	if err != nil {
+		s.debugln("unable to decode ftp name "+name, err)
+		return name
+	}
+	return decoded
+}
+
+// keepRemoteModTime : once path is stored, give it the archive's mtime of
+// remoteName for Last-Modified; the fetch time moves to a marker for cacheTTL
+func (s *Server) keepRemoteModTime(c *ftp.ServerConn, path string, remoteName string) {
+	if !c.IsGetTimeSupported() {
+		return
+	}
+	t, err := c.GetTime(s.ftpName(remoteName))
+	if err != nil {
+		s.debugln("unable to get the archive mtime of "+remoteName, err)
+		return
+	}
+	if err := os.WriteFile(path+fetchedSuffix, nil, 0644); err != nil {
+		logger.Println("unable to write fetch marker", err)
+		return
+	}
+	if err := os.Chtimes(path, t, t); err != nil {
+		logger.Println("unable to set the archive mtime", err)
+	}
+}
+
+// fetchedAt : when the local copy at path was retrieved; the later of its
+// marker and its own mtime, a copy stored since without the archive's mtime
+// keeping its fetch time
+func fetchedAt(path string, info os.FileInfo) time.Time {
+	marker, err := os.Stat(path + fetchedSuffix)
+	if err != nil || marker.ModTime().Before(info.ModTime()) {
+		return info.ModTime()
+	}
+	return marker.ModTime()
+}
+
+func (s *Server) retrieveFromServer(ctx context.Context, server string, directory string, filename string) (file *os.File, err error) {
+	cfg := s.cfg()
+
+	ctx, span := tracer.Start(ctx, "ftp.retrieve", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("ftp.server", server),
+			attribute.String("attestation.key", strings.TrimSuffix(filename, ".pdf")),
+		))
+
+	defer func() {
+		if isTimeout(err) {
+			s.markFtpFailure(server)
+			err = fmt.Errorf("%w: %w", errFtpTimeout, err)
+		}
+		endSpan(span, err)
+	}()
+
+	c, err := s.getFtpConn(ctx, server)
+	if err != nil {
+		s.markFtpFailure(server)
+		return file, err
+	}
+
+	// reject early when the server reports the size
+	if cfg.maxPdfBytes > 0 {
+		if size, err := c.FileSize(s.ftpName(s.ftpRemoteName(filename))); err == nil && size > cfg.maxPdfBytes {
+			s.putFtpConn(server, c)
+			return file, fmt.Errorf("%w: %s is %d bytes (max %d)", errPdfTooLarge, filename, size, cfg.maxPdfBytes)
+		}
+	}
+
+	// the archive stores some attestations compressed, the local copy is
+	// always the plain pdf
+	remoteName := s.ftpRemoteName(filename)
+	compressed := false
+	logger.Printf("retrieve from %s : %q\n", server, remoteName)
+	r, err := c.Retr(s.ftpName(remoteName))
+	if err != nil && ftpNotFound(err) {
+		remoteName += ".gz"
+		compressed = true
+		logger.Printf("retrieve from %s : %q\n", server, remoteName)
+		r, err = c.Retr(s.ftpName(remoteName))
+	}
+	if err != nil {
+		s.releaseFtpConn(server, c, err)
+		if ftpNotFound(err) {
+			return file, fmt.Errorf("%w: %s: %w", errFtpNotFound, filename, err)
+		}
+		return file, fmt.Errorf("%w: %s: %w", errFtpRetrieve, filename, err)
+	}
+
+	// closing the data connection aborts the transfer on cancellation
+	stop := context.AfterFunc(ctx, func() { r.Close() })
+	var src io.Reader = r
+	var gz *gzip.Reader
+	if compressed {
+		gz, err = gzip.NewReader(r)
+		src = gz
+	}
+	if err == nil {
+		file, err = s.storeDocument(directory, filename, src)
+	}
+	stop()
+	closeErr := r.Close()
+	switch {
+	case err != nil && ctx.Err() != nil:
+		err = ctx.Err()
+	case gz != nil && (errors.Is(err, gzip.ErrHeader) || errors.Is(err, gzip.ErrChecksum) || errors.Is(err, io.ErrUnexpectedEOF)):
+		err = fmt.Errorf("%w: %s: %w", errFtpCorrupt, remoteName, err)
+	case err != nil:
+		err = fmt.Errorf("%w: %s: %w", errFtpCopy, remoteName, err)
+	}
+
+	// an aborted transfer leaves the control connection in an unknown state
+	if err != nil {
+		c.Quit()
+		return file, err
+	}
+	if closeErr == nil {
+		s.keepRemoteModTime(c, file.Name(), remoteName)
+	}
+	s.releaseFtpConn(server, c, closeErr)
+
+	return file, err
+}
+
+// ftpPool : idle logged-in connections per server, kept alive with NOOP
+var ftpPool = struct {
+	sync.Mutex
+	idle map[string][]*ftp.ServerConn
+}{idle: make(map[string][]*ftp.ServerConn)}
+
+// warmupFtp : open perServer connections to every ftp server, maxFtpFetches
+// at a time, and pool them; returns how many succeeded and the last failure
+func (s *Server) warmupFtp(ctx context.Context, perServer int) (opened int, err error) {
+	type result struct {
+		server string
+		err    error
+	}
+	servers := s.ftpServers()
+	results := make(chan result, len(servers)*perServer)
+	for _, srv := range servers {
+		for i := 0; i < perServer; i++ {
+			go func(srv string) {
+				// at most maxFtpFetches dials at once
+				if s.ftpSlots != nil {
+					select {
+					case s.ftpSlots <- struct{}{}:
+						defer func() { <-s.ftpSlots }()
+					case <-ctx.Done():
+						results <- result{server: srv, err: ctx.Err()}
+						return
+					}
+				}
+				c, err := s.ftpConnect(ctx, srv)
+				if err == nil {
+					if err = c.NoOp(); err != nil {
+						c.Quit()
+					} else {
+						s.putFtpConn(srv, c)
+					}
+				}
+				results <- result{server: srv, err: err}
+			}(srv)
+		}
+	}
+
+	err = fmt.Errorf("%w: no ftp server configured", errBackend)
+	for i := 0; i < len(servers)*perServer; i++ {
+		select {
+		case res := <-results:
+			if res.err != nil {
+				logger.Println("ftp warmup: unable to connect to "+res.server, res.err)
+				s.markFtpFailure(res.server)
+				err = res.err
+				continue
+			}
+			opened++
+		case <-ctx.Done():
+			// late connections still land in the pool
+			return opened, ctx.Err()
+		}
+	}
+	if opened > 0 {
+		err = nil
+	}
+	return opened, err
+}
+
+// getFtpConn : idle pooled connection or a new one
+func (s *Server) getFtpConn(ctx context.Context, server string) (*ftp.ServerConn, error) {
+	ftpPool.Lock()
+	if conns := ftpPool.idle[server]; len(conns) > 0 {
+		c := conns[len(conns)-1]
+		ftpPool.idle[server] = conns[:len(conns)-1]
+		ftpPool.Unlock()
+		return c, nil
+	}
+	ftpPool.Unlock()
+	return s.ftpConnect(ctx, server)
+}
+
+// putFtpConn : keep the connection for reuse, or quit when the pool is full
+func (s *Server) putFtpConn(server string, c *ftp.ServerConn) {
+	ftpPool.Lock()
+	if len(ftpPool.idle[server]) < s.cfg().ftpPoolSize {
+		ftpPool.idle[server] = append(ftpPool.idle[server], c)
+		ftpPool.Unlock()
+		return
+	}
+	ftpPool.Unlock()
+	c.Quit()
+}
+
+// releaseFtpConn : back to the pool unless err shows the connection is broken
+func (s *Server) releaseFtpConn(server string, c *ftp.ServerConn, err error) {
+	var netErr net.Error
+	if err != nil && (errors.As(err, &netErr) || errors.Is(err, io.EOF)) {
+		c.Quit()
+		return
+	}
+	s.putFtpConn(server, c)
+}
+
+// openFiles : file descriptors held by the process, false where /proc
+// isn't available
+func openFiles() (int, bool) {
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return 0, false
+	}
+	return len(fds), true
+}
+
+// monitorResources : report DOWN on /healthz once goroutines or open files
+// pass their limit, so the orchestrator restarts a leaking process before
+// it runs out of descriptors; it never reports UP again
+func (s *Server) monitorResources(interval time.Duration, maxGoroutines int, maxFiles int) {
+	if _, ok := openFiles(); maxFiles > 0 && !ok {
+		logger.Println("open files can't be counted on this platform, -maxOpenFiles ignored")
+	}
+	for range time.Tick(interval) {
+		if atomic.LoadInt32(&shuttingDown) == 1 {
+			return
+		}
+		goroutines := runtime.NumGoroutine()
+		files, ok := openFiles()
+		switch {
+		case maxGoroutines > 0 && goroutines > maxGoroutines:
+			logger.Printf("%d goroutines, more than %d, reporting unhealthy\n", goroutines, maxGoroutines)
+		case maxFiles > 0 && ok && files > maxFiles:
+			logger.Printf("%d open files, more than %d, reporting unhealthy\n", files, maxFiles)
+		default:
+			s.debugln("resources", goroutines, "goroutines", files, "open files")
+			continue
+		}
+		atomic.StoreInt32(&healthy, 0)
+	}
+}
+
+// keepFtpAlive : NOOP idle connections so the server doesn't drop them,
+// discarding the ones that fail
+func (s *Server) keepFtpAlive(interval time.Duration) {
+	for range time.Tick(interval) {
+		// check outside the lock, NOOP may wait up to ftpOpTimeout
+		ftpPool.Lock()
+		idle := ftpPool.idle
+		ftpPool.idle = make(map[string][]*ftp.ServerConn)
+		ftpPool.Unlock()
+
+		for server, conns := range idle {
+			for _, c := range conns {
+				if err := c.NoOp(); err != nil {
+					logger.Println("drop idle ftp connection to "+server, err)
+					c.Quit()
+					continue
+				}
+				s.putFtpConn(server, c)
+			}
+		}
+	}
+}
+
+// storeDocument : copy a remote document into directory through a temp file
+func (s *Server) storeDocument(directory string, filename string, r io.Reader) (file *os.File, err error) {
+	cfg := s.cfg()
+
+	// the name comes from the request, it must land directly in directory
+	if rel, err := filepath.Rel(directory, filepath.Join(directory, filename)); err != nil || rel != filepath.Base(filename) {
+		return file, fmt.Errorf("%s would be stored outside of %s", filename, directory)
+	}
+
+	logger.Printf("Create temp file: %s/%q\n", s.tempDirectory(), filename)
+	dstFile, err := ioutil.TempFile(s.tempDirectory(), tempFilePrefix+filename+"-*")
+	if err != nil {
+		return file, err
+	}
+
+	var src io.Reader = r
+	if cfg.maxPdfBytes > 0 {
+		// read one byte past the limit to detect oversized files
+		src = io.LimitReader(r, cfg.maxPdfBytes+1)
+	}
+	// hide ReadFrom so the copy goes through our buffer
+	buf := s.copyBuffers.Get().(*[]byte)
+	n, err := io.CopyBuffer(struct{ io.Writer }{dstFile}, src, *buf)
+	s.copyBuffers.Put(buf)
+	if closeErr := dstFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dstFile.Name())
+		return file, err
+	}
+
+	if cfg.maxPdfBytes > 0 && n > cfg.maxPdfBytes {
+		// the copy stops one byte past the limit, n is a lower bound
+		logger.Printf("%q too large: %d bytes read, max %d\n", filename, n, cfg.maxPdfBytes)
+		os.Remove(dstFile.Name())
+		return file, fmt.Errorf("%w: %s is at least %d bytes (max %d)", errPdfTooLarge, filename, n, cfg.maxPdfBytes)
+	}
+
+	logger.Printf("Rename temp file: %s to %s/%q\n", dstFile.Name(), directory, filename)
+	if err := moveFile(dstFile.Name(), directory+"/"+filename); err != nil {
+		os.Remove(dstFile.Name())
+		return file, err
+	}
+
+	file, err = os.Open(directory + "/" + filename)
+	defer file.Close()
+
+	return file, err
+}
+
+// tempDirectory : where downloads are written before landing in directory
+func (s *Server) tempDirectory() string {
+	cfg := s.cfg()
+	if cfg.tempDir != "" {
+		return cfg.tempDir
+	}
+	return cfg.directory
+}
+
+// moveFile : rename, or copy then remove when src and dst are on different
+// filesystems (EXDEV)
+func moveFile(src string, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil || !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	// copy next to dst first so dst only ever appears complete
+	out, err := ioutil.TempFile(filepath.Dir(dst), tempFilePrefix+filepath.Base(dst)+"-*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		return err
+	}
+	return os.Remove(src)
 }
 
-func attestationPdf() http.Handler {
-
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-
-		logger.Println("attestation")
-
-		// get search key
-		keys, ok := r.URL.Query()["key"]
-		if !ok || len(keys[0]) < 1 {
-			w.WriteHeader(http.StatusBadRequest)
-			return
+// sweepTempFiles : remove temp files left behind by interrupted downloads
+func sweepTempFiles(directory string) {
+	matches, err := filepath.Glob(filepath.Join(directory, tempFilePrefix+"*"))
+	if err != nil {
+		logger.Println("unable to sweep temp files", err)
+		return
+	}
+	for _, m := range matches {
+		logger.Println("Remove orphaned temp file: " + m)
+		if err := os.Remove(m); err != nil {
+			logger.Println("unable to remove temp file", err)
 		}
-		key := keys[0]
+	}
+}
 
-		logger.Println("Url Param 'key' is: " + string(key))
-		logger.Println("directory is: " + directory)
+// retrieveFromS3 : download a document from the S3 compatible archive
+func (s *Server) retrieveFromS3(ctx context.Context, directory string, filename string) (file *os.File, err error) {
+	cfg := s.cfg()
 
-		// mapping to pdf file
-		filename := key + ".pdf"
-		currPath := directory + "/" + filename
-		logger.Println("Pdf location: " + currPath)
+	logger.Printf("retrieve from S3 : %s/%q\n", s.s3.bucket, filename)
+	obj, err := s.s3.client.GetObject(ctx, s.s3.bucket, filename, minio.GetObjectOptions{})
+	if err != nil {
+		return file, s3Error(err)
+	}
+	defer obj.Close()
 
-		file, err := os.Open(currPath)
-		if err != nil {
-			logger.Println("unable to find pdf. Trying to search on SRVDATA", err)
-			// [TODO] Upload depuis SRVDATA
-			_, err := retrieveFromSRVDATA(directory, filename)
-			if err != nil {
-				logger.Println("unable to find pdf", err)
-				w.Write([]byte(PdfNotFound))
-				return
-			}
-		}
-		defer file.Close()
+	// GetObject is lazy, Stat surfaces missing keys before copying
+	info, err := obj.Stat()
+	if err != nil {
+		return file, s3Error(err)
+	}
+	if cfg.maxPdfBytes > 0 && info.Size > cfg.maxPdfBytes {
+		return file, fmt.Errorf("%w: %s is %d bytes (max %d)", errPdfTooLarge, filename, info.Size, cfg.maxPdfBytes)
+	}
 
-		w.Header().Set("Content-Type", "application/pdf; charset=utf-8")
-		http.ServeFile(w, r, currPath)
-	})
+	return s.storeDocument(directory, filename, obj)
 }
 
-func retrieveFromSRVDATA(directory string, filename string) (file *os.File, err error) {
+// listOnS3 : keys of the pdfs starting with prefix in the bucket
+func (s *Server) listOnS3(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	for obj := range s.s3.client.ListObjects(ctx, s.s3.bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if obj.Err != nil {
+			return nil, s3Error(obj.Err)
+		}
+		if strings.HasSuffix(obj.Key, ".pdf") {
+			keys = append(keys, strings.TrimSuffix(obj.Key, ".pdf"))
+		}
+	}
+	return keys, nil
+}
 
-	c, err := ftp.Dial(ftpClient.srvFtp+":21", ftp.DialWithTimeout(5*time.Second))
-	if err != nil {
-		return file, err
+// statOnS3 : nil when filename is in the bucket
+func (s *Server) statOnS3(ctx context.Context, filename string) error {
+	if _, err := s.s3.client.StatObject(ctx, s.s3.bucket, filename, minio.StatObjectOptions{}); err != nil {
+		return s3Error(err)
 	}
+	return nil
+}
 
-	err = c.Login(ftpClient.userFtp, ftpClient.pwdFtp)
-	if err != nil {
-		return file, err
+// s3Error : map NoSuchKey to errDocumentNotFound, anything else to errBackend
+func s3Error(err error) error {
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return fmt.Errorf("%w: %v", errDocumentNotFound, err)
 	}
+	return fmt.Errorf("%w: %v", errBackend, err)
+}
 
-	logger.Println("retrieve from SRVDATA : " + filename)
-	r, err := c.Retr(filename)
-	if err != nil {
-		return file, err
+// setCacheControl : Cache-Control of a successful response, unless the
+// handler already chose one (e.g. no-store) or value is empty
+func setCacheControl(w http.ResponseWriter, value string) {
+	if value != "" && w.Header().Get("Cache-Control") == "" {
+		w.Header().Set("Cache-Control", value)
 	}
+}
 
-	logger.Println("Create temp file: " + directory + "/" + filename)
-	dstFile, err := ioutil.TempFile(directory, filename)
+// setContentType : text types are sent as utf-8, binary types never carry a charset
+func setContentType(w http.ResponseWriter, mimeType string) {
+	if strings.HasPrefix(mimeType, "text/") {
+		mimeType += "; charset=utf-8"
+	}
+	w.Header().Set("Content-Type", mimeType)
+}
 
-	_, err = io.Copy(dstFile, r)
-	err = dstFile.Close()
+// writeError : JSON error body for API clients, HTML page for browsers
+func writeError(w http.ResponseWriter, r *http.Request, status int, message string, page string) {
+	// errors must not be cached with the success max-age
+	w.Header().Del("Cache-Control")
+	if acceptsJSON(r) {
+		setContentType(w, "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error": map[string]interface{}{
+				"code":    status,
+				"message": message,
+			},
+		})
+		return
+	}
 
-	logger.Println("Rename temp file: " + dstFile.Name() + " to " + directory + "/" + filename)
-	os.Rename(dstFile.Name(), directory+"/"+filename)
+	if page == "" {
+		page = fmt.Sprintf(ErrorTemplate, html.EscapeString(message))
+	}
+	setContentType(w, "text/html")
+	w.WriteHeader(status)
+	w.Write([]byte(page))
+}
 
-	if err := c.Quit(); err != nil {
-		log.Fatal(err)
+// preferredLanguage : best supported language of Accept-Language by q-value,
+// defaultLanguage when none match
+func preferredLanguage(r *http.Request) string {
+	best, bestQ := defaultLanguage, 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		fields := strings.Split(strings.TrimSpace(part), ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		// "en-GB" matches "en"
+		if i := strings.Index(tag, "-"); i > 0 {
+			tag = tag[:i]
+		}
+		if _, ok := pdfNotFoundPages[tag]; !ok {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			if v := strings.TrimSpace(param); strings.HasPrefix(v, "q=") {
+				if f, err := strconv.ParseFloat(v[2:], 64); err == nil {
+					q = f
+				}
+			}
+		}
+		if q > bestQ {
+			best, bestQ = tag, q
+		}
 	}
-	file, err = os.Open(directory + "/" + filename)
-	defer file.Close()
+	return best
+}
 
-	return file, err
+// acceptsJSON : the first of json or html listed in Accept wins
+func acceptsJSON(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch mediaType {
+		case "application/json":
+			return true
+		case "text/html":
+			return false
+		}
+	}
+	return false
 }
 
 /*
@@ -267,18 +4749,22 @@ func attestation() http.Handler {
 			return
 		}
 		key := keys[0]
+		if !validKey(key) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
 
 		log.Println("Url Param 'key' is: " + string(key))
 
 		// mapping to image file
-		currPath := directory + "/" + key + ".png"
+		currPath := currentDirectory() + "/" + key + ".png"
 		log.Println("Image location: " + currPath)
 
 		file, err := os.Open(currPath)
 		if err != nil {
 			log.Println("unable to find image.", err)
 			w.WriteHeader(http.StatusNotFound)
-			w.Write([]byte(ImageNotFound))
+			w.Write([]byte(imageNotFoundPages[preferredLanguage(r)]))
 			return
 		}
 		defer file.Close()
@@ -316,26 +4802,549 @@ func attestation() http.Handler {
 }
 */
 
-func logging() func(http.Handler) http.Handler {
+// responseRecorder : wraps http.ResponseWriter to capture status and size
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int64
+	err    error // first write error
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	// a body written without WriteHeader is an implicit 200
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.size += int64(n)
+	if err != nil && rec.err == nil {
+		rec.err = err
+	}
+	return n, err
+}
+
+// statusCode : status sent to the client, 200 when the handler wrote nothing
+func (rec *responseRecorder) statusCode() int {
+	if rec.status == 0 {
+		return http.StatusOK
+	}
+	return rec.status
+}
+
+// redactedHeaders : credentials never kept in recordings
+var redactedHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+	"X-Api-Key":           true,
+}
+
+// recordedRequest : one sampled request and its outcome
+type recordedRequest struct {
+	Time       time.Time           `json:"time"`
+	RequestID  string              `json:"requestId"`
+	Method     string              `json:"method"`
+	Path       string              `json:"path"`
+	Query      string              `json:"query"`
+	ClientIP   string              `json:"clientIp"`
+	Headers    map[string][]string `json:"headers"`
+	Status     int                 `json:"status"`
+	Size       int64               `json:"size"`
+	DurationMs float64             `json:"durationMs"`
+}
+
+// recording : keep -recordRate of the requests in the recordings ring;
+// sampling is by count, rate 0.1 records every tenth request
+func (s *Server) recording() func(http.Handler) http.Handler {
+	cfg := s.cfg()
+	return func(next http.Handler) http.Handler {
+		if cfg.recordRate <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := atomic.AddInt64(&s.recordings.seen, 1)
+			if math.Floor(float64(n)*cfg.recordRate) == math.Floor(float64(n-1)*cfg.recordRate) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			headers := make(map[string][]string, len(r.Header))
+			for name, values := range r.Header {
+				if redactedHeaders[name] {
+					values = []string{"[redacted]"}
+				}
+				headers[name] = values
+			}
+			requestID, _ := r.Context().Value(requestIDKey).(string)
+			entry := recordedRequest{
+				Time:      time.Now(),
+				RequestID: requestID,
+				Method:    r.Method,
+				Path:      r.URL.Path,
+				Query:     r.URL.RawQuery,
+				ClientIP:  s.clientIP(r),
+				Headers:   headers,
+			}
+
+			rec := &responseRecorder{ResponseWriter: w}
+			next.ServeHTTP(rec, r)
+			entry.Status = rec.statusCode()
+			entry.Size = rec.size
+			entry.DurationMs = float64(time.Since(entry.Time).Microseconds()) / 1000
+
+			s.recordings.Lock()
+			if len(s.recordings.entries) < cap(s.recordings.entries) {
+				s.recordings.entries = append(s.recordings.entries, entry)
+			} else {
+				s.recordings.entries[s.recordings.next] = entry
+			}
+			s.recordings.next = (s.recordings.next + 1) % cap(s.recordings.entries)
+			s.recordings.Unlock()
+		})
+	}
+}
+
+// listRecordings : the recordings ring, oldest first
+func (s *Server) listRecordings() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.recordings.Lock()
+		entries := make([]recordedRequest, 0, len(s.recordings.entries))
+		if len(s.recordings.entries) == cap(s.recordings.entries) {
+			entries = append(entries, s.recordings.entries[s.recordings.next:]...)
+			entries = append(entries, s.recordings.entries[:s.recordings.next]...)
+		} else {
+			entries = append(entries, s.recordings.entries...)
+		}
+		s.recordings.Unlock()
+
+		setContentType(w, "application/json")
+		json.NewEncoder(w).Encode(entries)
+	})
+}
+
+func (s *Server) logging() func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cfg := s.cfg()
+			rec := &responseRecorder{ResponseWriter: w}
+			start := time.Now()
+
+			// probes stay out of the access log, traced only at debug level
+			if cfg.logSkipPaths[r.URL.Path] {
+				next.ServeHTTP(rec, r)
+				requestID, _ := r.Context().Value(requestIDKey).(string)
+				s.debugln(requestID, r.Method, r.URL.Path, rec.statusCode(), rec.size, time.Since(start), s.clientIP(r))
+				return
+			}
+
 			defer func() {
-				requestID, ok := r.Context().Value(requestIDKey).(string)
-				if !ok {
-					requestID = "unknown"
+				requestID, _ := r.Context().Value(requestIDKey).(string)
+				s.debugln(requestID, "status", rec.statusCode(), "bytes", rec.size, "duration", time.Since(start))
+
+				switch cfg.accessLogFormat {
+				case "common", "combined":
+					fmt.Fprintln(logger.Writer(), s.apacheLogLine(r, rec, start))
+				default:
+					requestID, ok := r.Context().Value(requestIDKey).(string)
+					if !ok {
+						requestID = "unknown"
+					}
+					logger.Println(requestID, r.Method, r.URL.Path, rec.statusCode(), rec.size, s.clientIP(r), r.UserAgent())
 				}
-				logger.Println(requestID, r.Method, r.URL.Path, r.RemoteAddr, r.UserAgent())
 			}()
+			next.ServeHTTP(rec, r)
+		})
+	}
+}
+
+// Metrics : hooks called by the middleware and handlers. The default is a
+// no-op; implement it to export to another backend (StatsD, OpenTelemetry...)
+// and assign it to Server.metrics before the server starts. Implementations must be
+// safe for concurrent use.
+type Metrics interface {
+	// IncRequest : one request served on route (the registered pattern) with status
+	IncRequest(route string, status int)
+	// ObserveLatency : time spent serving one request on route
+	ObserveLatency(route string, d time.Duration)
+	// IncFtpFetch : one archive retrieval after a local miss, ok false when it failed
+	IncFtpFetch(ok bool)
+	// IncBarcode : one barcode image generated in format
+	IncBarcode(format string)
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) IncRequest(route string, status int)          {}
+func (noopMetrics) ObserveLatency(route string, d time.Duration) {}
+func (noopMetrics) IncFtpFetch(ok bool)                          {}
+func (noopMetrics) IncBarcode(format string)                     {}
+
+// prometheusMetrics : Metrics exposed on /metrics
+type prometheusMetrics struct {
+	requests   *prometheus.CounterVec
+	latency    *prometheus.HistogramVec
+	ftpFetches *prometheus.CounterVec
+	barcodes   *prometheus.CounterVec
+}
+
+func newPrometheusMetrics(reg prometheus.Registerer) *prometheusMetrics {
+	m := &prometheusMetrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "vetsheet_http_requests_total",
+			Help: "Requests served by route and status code.",
+		}, []string{"route", "status"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "vetsheet_http_request_duration_seconds",
+			Help:    "Request latency by route.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route"}),
+		ftpFetches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "vetsheet_archive_fetches_total",
+			Help: "Archive retrievals by outcome.",
+		}, []string{"outcome"}),
+		barcodes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "vetsheet_barcodes_generated_total",
+			Help: "Barcodes generated by format.",
+		}, []string{"format"}),
+	}
+	reg.MustRegister(m.requests, m.latency, m.ftpFetches, m.barcodes)
+	return m
+}
+
+func (m *prometheusMetrics) IncRequest(route string, status int) {
+	m.requests.WithLabelValues(route, strconv.Itoa(status)).Inc()
+}
+
+func (m *prometheusMetrics) ObserveLatency(route string, d time.Duration) {
+	m.latency.WithLabelValues(route).Observe(d.Seconds())
+}
+
+func (m *prometheusMetrics) IncFtpFetch(ok bool) {
+	outcome := "success"
+	if !ok {
+		outcome = "failure"
+	}
+	m.ftpFetches.WithLabelValues(outcome).Inc()
+}
+
+func (m *prometheusMetrics) IncBarcode(format string) {
+	m.barcodes.WithLabelValues(format).Inc()
+}
+
+// mount : serve next under -basePath with the prefix stripped, /healthz
+// stays reachable at the root unless -basePathHealthz
+func (s *Server) mount(next http.Handler) http.Handler {
+	cfg := s.cfg()
+	if cfg.basePath == "" {
+		return next
+	}
+	mux := http.NewServeMux()
+	mux.Handle(cfg.basePath+"/", http.StripPrefix(cfg.basePath, next))
+	if !cfg.basePathHealthz {
+		mux.Handle("/healthz", next)
+	}
+	return mux
+}
+
+// measuring : report each request to metrics, labelled with the matched
+// route pattern to keep cardinality bounded
+func (s *Server) measuring(router *http.ServeMux) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rec := &responseRecorder{ResponseWriter: w}
+			start := time.Now()
+			next.ServeHTTP(rec, r)
+
+			_, route := router.Handler(r)
+			if route == "" {
+				route = "unmatched"
+			}
+			s.metrics.IncRequest(route, rec.statusCode())
+			s.metrics.ObserveLatency(route, time.Since(start))
+		})
+	}
+}
+
+// tracer : spans are dropped unless setupTracing installs an exporter
+var tracer = otel.Tracer(serviceName)
+
+// setupTracing : export spans over OTLP when the standard OTEL_EXPORTER_OTLP_*
+// variables configure an endpoint, otherwise leave the no-op provider
+func setupTracing(ctx context.Context) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.New(ctx,
+		resource.WithFromEnv(),
+		resource.WithAttributes(attribute.String("service.name", serviceName), attribute.String("service.version", version)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	tracer = provider.Tracer(serviceName)
+
+	return provider.Shutdown, nil
+}
+
+// spans : one server span per request, continuing an incoming traceparent
+func spans() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+			ctx, span := tracer.Start(ctx, r.Method+" "+r.URL.Path,
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					attribute.String("http.method", r.Method),
+					attribute.String("http.target", r.URL.Path),
+				))
+			defer span.End()
+
+			rec := &responseRecorder{ResponseWriter: w}
+			next.ServeHTTP(rec, r.WithContext(ctx))
+
+			span.SetAttributes(attribute.Int("http.status_code", rec.statusCode()))
+			if rec.statusCode() >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(rec.statusCode()))
+			}
+		})
+	}
+}
+
+// counting : maintain request counters reported by /status
+func counting() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt64(&stats.requests, 1)
+			atomic.AddInt64(&stats.inFlight, 1)
+			defer atomic.AddInt64(&stats.inFlight, -1)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// headers : -header values and the security defaults on every response,
+// set first so handlers can still override them
+func (s *Server) headers() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cfg := s.cfg()
+			for name, value := range cfg.responseHeaders {
+				w.Header().Set(name, value)
+			}
+			if cfg.hstsHeader != "" && s.isHTTPS(r) {
+				w.Header().Set("Strict-Transport-Security", cfg.hstsHeader)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// isHTTPS : request reached us, or the trusted proxy in front of us, over tls
+func (s *Server) isHTTPS(r *http.Request) bool {
+	if r.TLS != nil {
+		return true
+	}
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+	return s.isTrustedProxy(peer) && strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")
+}
+
+// draining : once shutdown begins, new requests fail fast with 503 so clients
+// retry elsewhere, while requests already past this point complete
+func draining() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.LoadInt32(&shuttingDown) == 1 {
+				w.Header().Set("Retry-After", drainRetryAfter)
+				w.Header().Set("Connection", "close")
+				writeError(w, r, http.StatusServiceUnavailable, "server is shutting down", "")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// allowMethods : answer 405 with an Allow header for any other method,
+// GET also accepts HEAD
+func allowMethods(next http.Handler, methods ...string) http.Handler {
+	for _, m := range methods {
+		if m == http.MethodGet {
+			methods = append(methods, http.MethodHead)
+			break
+		}
+	}
+	allow := strings.Join(methods, ", ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, m := range methods {
+			if r.Method == m {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		w.Header().Set("Allow", allow)
+		writeError(w, r, http.StatusMethodNotAllowed, "method not allowed", "")
+	})
+}
+
+// limitBodies : 413 for a declared Content-Length past the limit of the
+// path, and a MaxBytesReader for the bodies streamed without one
+func limitBodies(limits map[string]int64, defaultLimit int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			limit, ok := limits[r.URL.Path]
+			if !ok {
+				limit = defaultLimit
+			}
+			if r.ContentLength > limit {
+				writeError(w, r, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body larger than %d bytes", limit), "")
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
 			next.ServeHTTP(w, r)
 		})
 	}
 }
 
+// requireAdmin : /admin endpoints, api key and a client in -adminAllowFrom
+func (s *Server) requireAdmin(next http.Handler) http.Handler {
+	next = s.requireAPIKey(next)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := net.ParseIP(s.clientIP(r))
+		for _, network := range s.cfg().adminAllowFrom {
+			if ip != nil && network.Contains(ip) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		logger.Println("admin request refused from " + s.clientIP(r))
+		writeError(w, r, http.StatusForbidden, "admin endpoints aren't reachable from this address", "")
+	})
+}
+
+// requireAPIKey : reject requests without the X-API-Key header when -apiKey is set
+func (s *Server) requireAPIKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := s.cfg()
+		if cfg.apiKey != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("X-API-Key")), []byte(cfg.apiKey)) != 1 {
+			writeError(w, r, http.StatusUnauthorized, "missing or invalid api key", "")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientIP : address of the client, read from X-Forwarded-For / X-Real-IP only
+// when the direct peer is a trusted proxy so the headers can't be spoofed
+func (s *Server) clientIP(r *http.Request) string {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+	if !s.isTrustedProxy(peer) {
+		return peer
+	}
+
+	// walk the chain right to left, the first untrusted hop is the client
+	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+		hops := strings.Split(xff, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			if !s.isTrustedProxy(hop) || i == 0 {
+				return hop
+			}
+		}
+	}
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+	return peer
+}
+
+// isTrustedProxy : ip belongs to one of -trustedProxies
+func (s *Server) isTrustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range s.cfg().trustedProxies {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyProtocolPolicy : honour PROXY headers from -proxyProtocolFrom only,
+// anyone else sending one is disconnected
+func (s *Server) proxyProtocolPolicy(upstream net.Addr) (proxyproto.Policy, error) {
+	host, _, err := net.SplitHostPort(upstream.String())
+	if err != nil {
+		return proxyproto.REJECT, nil
+	}
+	ip := net.ParseIP(host)
+	for _, network := range s.cfg().proxyProtocolFrom {
+		if ip != nil && network.Contains(ip) {
+			return proxyproto.USE, nil
+		}
+	}
+	return proxyproto.REJECT, nil
+}
+
+// debugln : log only when -debug is set
+func (s *Server) debugln(v ...interface{}) {
+	if s.cfg().debug {
+		logger.Println(append([]interface{}{"DEBUG"}, v...)...)
+	}
+}
+
+// apacheLogLine : format a request in Apache Common or Combined Log Format
+func (s *Server) apacheLogLine(r *http.Request, rec *responseRecorder, start time.Time) string {
+	host := s.clientIP(r)
+	user := "-"
+	if u, _, ok := r.BasicAuth(); ok && u != "" {
+		user = u
+	}
+	status := rec.statusCode()
+	size := "-"
+	if rec.size > 0 {
+		size = strconv.FormatInt(rec.size, 10)
+	}
+
+	line := fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %s",
+		host, user, start.Format("02/Jan/2006:15:04:05 -0700"),
+		r.Method, r.RequestURI, r.Proto, status, size)
+	if s.cfg().accessLogFormat == "combined" {
+		line += fmt.Sprintf(" %q %q", r.Referer(), r.UserAgent())
+	}
+	return line
+}
+
 func tracing(nextRequestID func() string) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			requestID := r.Header.Get("X-Request-Id")
-			if requestID == "" {
+			if !validRequestID(requestID) {
 				requestID = nextRequestID()
 			}
 			ctx := context.WithValue(r.Context(), requestIDKey, requestID)
@@ -344,3 +5353,20 @@ func tracing(nextRequestID func() string) func(http.Handler) http.Handler {
 		})
 	}
 }
+
+// validRequestID : accept only short ids made of safe characters so a client
+// can't forge log lines through the X-Request-Id header
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,1090 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"image/png"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/boombuler/barcode"
+	"github.com/boombuler/barcode/code128"
+	"github.com/jlaffaye/ftp"
+)
+
+func TestMain(m *testing.M) {
+	logger = log.New(io.Discard, "", 0)
+	os.Exit(m.Run())
+}
+
+// newTestHandler : server of the flags in args over a temporary directory,
+// and its handler
+func newTestHandler(tb testing.TB, args ...string) (*Server, http.Handler) {
+	tb.Helper()
+
+	cfg, err := parseConfig(append([]string{"-directory", tb.TempDir()}, args...))
+	if err != nil {
+		tb.Fatalf("parseConfig(%q): %v", args, err)
+	}
+	srv, err := newServer(cfg)
+	if err != nil {
+		tb.Fatalf("newServer: %v", err)
+	}
+	handler := srv.httpServer().Handler
+	atomic.StoreInt32(&healthy, 1)
+	return srv, handler
+}
+
+// testServer : newTestHandler listening on a loopback port
+type testServer struct {
+	*httptest.Server
+	srv *Server
+}
+
+// newTestServer : testServer of the flags in args, closed with the test
+func newTestServer(t *testing.T, args ...string) *testServer {
+	t.Helper()
+	srv, handler := newTestHandler(t, args...)
+	ts := &testServer{Server: httptest.NewServer(handler), srv: srv}
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// directory : local document directory of the server
+func (ts *testServer) directory() string {
+	return ts.srv.cfg().directory
+}
+
+// get : body of a GET on the test server
+func get(t *testing.T, ts *testServer, path string) (*http.Response, []byte) {
+	t.Helper()
+	resp, err := http.Get(ts.URL + path)
+	if err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	return resp, body
+}
+
+// ftpStub : in-process ftp server with files in memory, passive mode only,
+// answering the commands the jlaffaye/ftp client sends
+type ftpStub struct {
+	listener net.Listener
+	files    map[string][]byte
+
+	mu       sync.Mutex
+	commands []string
+	retrs    map[string]int
+
+	// stall : RETR opens the transfer but never sends the data
+	stall bool
+	// delay : RETR waits this long before sending the data
+	delay time.Duration
+	// done : closed when the stub stops, releases stalled transfers
+	done chan struct{}
+}
+
+// newFtpStub : ftp server on a loopback port serving files, stopped with
+// the test
+func newFtpStub(t *testing.T, files map[string][]byte) *ftpStub {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &ftpStub{listener: l, files: files, retrs: make(map[string]int), done: make(chan struct{})}
+	go s.serve()
+	t.Cleanup(func() {
+		close(s.done)
+		l.Close()
+	})
+	return s
+}
+
+// addr : host:port for -srvFtp
+func (s *ftpStub) addr() string {
+	return s.listener.Addr().String()
+}
+
+// retrCount : RETR commands received for name
+func (s *ftpStub) retrCount(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.retrs[name]
+}
+
+// received : true when a command starting with verb was sent
+func (s *ftpStub) received(verb string) bool {
+	return s.count(verb) > 0
+}
+
+// count : commands starting with verb received so far
+func (s *ftpStub) count(verb string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, c := range s.commands {
+		if c == verb || strings.HasPrefix(c, verb+" ") {
+			n++
+		}
+	}
+	return n
+}
+
+func (s *ftpStub) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.session(conn)
+	}
+}
+
+func (s *ftpStub) session(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(format string, args ...interface{}) {
+		fmt.Fprintf(conn, format+"\r\n", args...)
+	}
+
+	var data net.Listener
+	defer func() {
+		if data != nil {
+			data.Close()
+		}
+	}()
+	// accept : the data connection the client opened after EPSV/PASV
+	accept := func() net.Conn {
+		if data == nil {
+			return nil
+		}
+		defer func() { data.Close(); data = nil }()
+		data.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+		c, err := data.Accept()
+		if err != nil {
+			return nil
+		}
+		return c
+	}
+
+	reply("220 stub ready")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		verb, arg, _ := strings.Cut(line, " ")
+		verb = strings.ToUpper(verb)
+		s.mu.Lock()
+		s.commands = append(s.commands, strings.TrimSpace(verb+" "+arg))
+		s.mu.Unlock()
+
+		switch verb {
+		case "USER":
+			reply("331 password required")
+		case "PASS":
+			reply("230 logged in")
+		case "FEAT":
+			reply("211-Features:\r\n MDTM\r\n SIZE\r\n211 End")
+		case "TYPE", "NOOP":
+			reply("200 ok")
+		case "CWD":
+			reply("250 ok")
+		case "PWD":
+			reply(`257 "/"`)
+		case "QUIT":
+			reply("221 bye")
+			return
+		case "EPSV", "PASV":
+			if data, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+				reply("425 no data connection")
+				continue
+			}
+			port := data.Addr().(*net.TCPAddr).Port
+			if verb == "EPSV" {
+				reply("229 Entering Extended Passive Mode (|||%d|)", port)
+			} else {
+				reply("227 Entering Passive Mode (127,0,0,1,%d,%d)", port/256, port%256)
+			}
+		case "SIZE":
+			if b, ok := s.files[arg]; ok {
+				reply("213 %d", len(b))
+			} else {
+				reply("550 not found")
+			}
+		case "MDTM":
+			if _, ok := s.files[arg]; ok {
+				reply("213 20240102030405")
+			} else {
+				reply("550 not found")
+			}
+		case "RETR":
+			s.mu.Lock()
+			s.retrs[arg]++
+			s.mu.Unlock()
+			c := accept()
+			b, ok := s.files[arg]
+			if c == nil || !ok {
+				if c != nil {
+					c.Close()
+				}
+				reply("550 not found")
+				continue
+			}
+			reply("150 opening data connection")
+			if s.stall {
+				// until the client gives up and closes its end
+				closed := make(chan struct{})
+				go func() {
+					io.Copy(io.Discard, c)
+					close(closed)
+				}()
+				select {
+				case <-closed:
+				case <-s.done:
+				case <-time.After(10 * time.Second):
+				}
+				c.Close()
+				reply("426 transfer aborted")
+				continue
+			}
+			select {
+			case <-time.After(s.delay):
+			case <-s.done:
+			}
+			c.Write(b)
+			c.Close()
+			reply("226 transfer complete")
+		case "NLST":
+			c := accept()
+			if c == nil {
+				reply("425 no data connection")
+				continue
+			}
+			reply("150 opening data connection")
+			for name := range s.files {
+				fmt.Fprintf(c, "%s\r\n", name)
+			}
+			c.Close()
+			reply("226 transfer complete")
+		default:
+			reply("502 %s not implemented", verb)
+		}
+	}
+}
+
+// samplePdf : minimal content served as a pdf by the stubs
+var samplePdf = []byte("%PDF-1.4\n% stub attestation\n%%EOF\n")
+
+func TestFtpAddress(t *testing.T) {
+	tests := map[string]string{
+		"srvdata":          "srvdata:21",
+		"srvdata:2121":     "srvdata:2121",
+		"10.0.0.1":         "10.0.0.1:21",
+		"[::1]:2121":       "[::1]:2121",
+		"127.0.0.1:0":      "127.0.0.1:0",
+		"ftp.example.test": "ftp.example.test:21",
+	}
+	for server, want := range tests {
+		if got := ftpAddress(server); got != want {
+			t.Errorf("ftpAddress(%q) = %q, want %q", server, got, want)
+		}
+	}
+}
+
+func TestApplySettingsSwapsConfig(t *testing.T) {
+	ts := newTestServer(t)
+	before := ts.srv.cfg()
+	first := before.directory
+	if err := os.WriteFile(filepath.Join(first, "WA46668.pdf"), samplePdf, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	second := t.TempDir()
+	ts.srv.applySettings(settings{directory: second, debug: true})
+
+	// requests holding the previous config never see it change
+	if before.directory != first || before.debug {
+		t.Errorf("previous config modified: directory %q, debug %v", before.directory, before.debug)
+	}
+	if after := ts.srv.cfg(); after == before || after.directory != second || !after.debug {
+		t.Errorf("reloaded config: directory %q, debug %v, want %q, true", after.directory, after.debug, second)
+	}
+	if resp, _ := get(t, ts, "/attestation?key=WA46668"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("status %d after the reload, want 404 from the new directory", resp.StatusCode)
+	}
+}
+
+func TestServersAreIndependent(t *testing.T) {
+	a := newTestServer(t, "-metrics", "prometheus", "-barcodeCacheBytes", "1048576")
+	ftpd := newFtpStub(t, nil)
+	b := newTestServer(t, "-metrics", "prometheus", "-srvFtp", ftpd.addr())
+	if err := os.WriteFile(filepath.Join(a.directory(), "WA46668.pdf"), samplePdf, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp, _ := get(t, a, "/attestation?key=WA46668"); resp.StatusCode != http.StatusOK {
+		t.Errorf("a: status %d, want 200", resp.StatusCode)
+	}
+	if resp, _ := get(t, b, "/attestation?key=WA46668"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("b: status %d, want 404, its directory is empty", resp.StatusCode)
+	}
+	if a.srv.barcodeCache == nil || b.srv.barcodeCache != nil {
+		t.Error("barcode cache shared between servers")
+	}
+
+	// each server counts its own requests
+	_, body := get(t, b, "/metrics")
+	if !strings.Contains(string(body), `status="404"`) || strings.Contains(string(body), `status="200"`) {
+		t.Errorf("b's metrics, want its 404 and not a's 200:\n%s", body)
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	ts := newTestServer(t)
+
+	resp, body := get(t, ts, "/healthz")
+	if resp.StatusCode != http.StatusOK || strings.TrimSpace(string(body)) != "UP" {
+		t.Fatalf("healthy: %d %q, want 200 UP", resp.StatusCode, body)
+	}
+
+	atomic.StoreInt32(&healthy, 0)
+	resp, _ = get(t, ts, "/healthz")
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("unhealthy: %d, want 503", resp.StatusCode)
+	}
+}
+
+func TestSampleIdToBarCode(t *testing.T) {
+	ts := newTestServer(t)
+
+	resp, body := get(t, ts, "/sampleIdToBarCode?key=SCC1165613")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d: %s", resp.StatusCode, body)
+	}
+	path := filepath.Join(ts.directory(), "SCC1165613.png")
+	if !strings.Contains(string(body), "SCC1165613.png") {
+		t.Errorf("body %q doesn't name %s", body, path)
+	}
+	if b, err := os.ReadFile(path); err != nil || !strings.HasPrefix(string(b), "\x89PNG") {
+		t.Errorf("%s isn't a png: %v", path, err)
+	}
+
+	for _, query := range []string{"", "?key=", "?key=SCC1165613&format=bmp", "?key=SCC1165613&width=0"} {
+		if resp, _ := get(t, ts, "/sampleIdToBarCode"+query); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", query, resp.StatusCode)
+		}
+	}
+}
+
+func TestAttestationFromFtp(t *testing.T) {
+	ftpd := newFtpStub(t, map[string][]byte{"WA46668.pdf": samplePdf})
+	ts := newTestServer(t, "-srvFtp", ftpd.addr(), "-userFtp", "vet", "-pwdFtp", "secret")
+
+	for i := 0; i < 2; i++ {
+		resp, body := get(t, ts, "/attestation?key=WA46668")
+		if resp.StatusCode != http.StatusOK || string(body) != string(samplePdf) {
+			t.Fatalf("request %d: %d %q", i, resp.StatusCode, body)
+		}
+	}
+	// the second request is served from directory
+	if n := ftpd.retrCount("WA46668.pdf"); n != 1 {
+		t.Errorf("%d RETR, want 1", n)
+	}
+	if _, err := os.Stat(filepath.Join(ts.directory(), "WA46668.pdf")); err != nil {
+		t.Errorf("pdf not cached: %v", err)
+	}
+
+	resp, _ := get(t, ts, "/attestation?key=WA00000")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("missing key: status %d, want 404", resp.StatusCode)
+	}
+}
+
+func TestAttestationRemoteModTime(t *testing.T) {
+	ftpd := newFtpStub(t, map[string][]byte{"WA46668.pdf": samplePdf})
+	ts := newTestServer(t, "-srvFtp", ftpd.addr(), "-cacheTTL", "1h")
+	archived := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	for i := 0; i < 2; i++ {
+		resp, _ := get(t, ts, "/attestation?key=WA46668")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d: status %d", i, resp.StatusCode)
+		}
+		if lm := resp.Header.Get("Last-Modified"); lm != archived.Format(http.TimeFormat) {
+			t.Errorf("request %d: Last-Modified %q, want the archive's %v", i, lm, archived)
+		}
+	}
+	// the archive's mtime is older than cacheTTL, the fetch time is not
+	if n := ftpd.retrCount("WA46668.pdf"); n != 1 {
+		t.Errorf("%d RETR, want 1", n)
+	}
+	// MDTM only once the transfer completed
+	if n := ftpd.count("MDTM"); n != 1 {
+		t.Errorf("MDTM sent %d times, want 1", n)
+	}
+
+	// kept on disk, not in memory
+	info, err := os.Stat(filepath.Join(ts.directory(), "WA46668.pdf"))
+	if err != nil || !info.ModTime().Equal(archived) {
+		t.Errorf("local mtime %v (%v), want %v", info.ModTime(), err, archived)
+	}
+	if _, err := os.Stat(filepath.Join(ts.directory(), "WA46668.pdf"+fetchedSuffix)); err != nil {
+		t.Errorf("no fetch marker: %v", err)
+	}
+}
+
+func TestAttestationFtpDown(t *testing.T) {
+	// nothing listens on a closed listener's port
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	ts := newTestServer(t, "-srvFtp", addr, "-ftpDialTimeout", "1s")
+	resp, _ := get(t, ts, "/attestation?key=WA46668")
+	if resp.StatusCode != http.StatusBadGateway && resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status %d, want 502 or 503", resp.StatusCode)
+	}
+}
+
+func BenchmarkGenerateBarCode(b *testing.B) {
+	_, handler := newTestHandler(b)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sampleIdToBarCode?key=SCC1165613&width=800&height=200&force=true", nil))
+		if rec.Code != http.StatusOK {
+			b.Fatalf("status %d: %s", rec.Code, rec.Body)
+		}
+	}
+}
+
+func BenchmarkScaleBarcode(b *testing.B) {
+	for _, size := range []struct{ width, height int }{
+		{200, 50}, {400, 100}, {800, 200}, {1600, 400}, {maxBarcodeSize, maxBarcodeSize / 4},
+	} {
+		b.Run(fmt.Sprintf("%dx%d", size.width, size.height), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				bc, err := code128.Encode("SCC1165613")
+				if err != nil {
+					b.Fatal(err)
+				}
+				margin := quietZoneModules * max(size.width/bc.Bounds().Dx(), 1)
+				if _, err := scaleBarcode(bc, size.width, size.height, margin); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkAttestationLocalHit(b *testing.B) {
+	srv, handler := newTestHandler(b)
+	if err := os.WriteFile(filepath.Join(srv.cfg().directory, "DEMO0001.pdf"), samplePdf, 0644); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/attestation?key=DEMO0001", nil))
+		if rec.Code != http.StatusOK {
+			b.Fatalf("status %d: %s", rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestFtpDialOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		// passive command the client must send, the other one must not be seen
+		passive, notPassive string
+		// stall : the transfer never sends data, the read must time out
+		stall   bool
+		options int
+	}{
+		{"epsv", Config{ftpDialTimeout: time.Second}, "EPSV", "PASV", false, 2},
+		{"epsv disabled", Config{ftpDialTimeout: time.Second, ftpDisableEPSV: true}, "PASV", "EPSV", false, 2},
+		{"data timeout", Config{ftpDialTimeout: time.Second, ftpDataTimeout: 200 * time.Millisecond}, "EPSV", "PASV", true, 3},
+		{"data timeout from op timeout", Config{ftpDialTimeout: time.Second, ftpOpTimeout: 200 * time.Millisecond}, "EPSV", "PASV", true, 3},
+		{"pasv data timeout", Config{ftpDialTimeout: time.Second, ftpDisableEPSV: true, ftpDataTimeout: 200 * time.Millisecond}, "PASV", "EPSV", true, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := ftpDialOptions(&tt.cfg)
+			if len(options) != tt.options {
+				t.Errorf("%d options, want %d", len(options), tt.options)
+			}
+
+			stub := newFtpStub(t, map[string][]byte{"WA46668.pdf": samplePdf})
+			stub.stall = tt.stall
+			c, err := ftp.Dial(stub.addr(), options...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Quit()
+			if err := c.Login("vet", "secret"); err != nil {
+				t.Fatal(err)
+			}
+			r, err := c.Retr("WA46668.pdf")
+			if err != nil {
+				t.Fatal(err)
+			}
+			start := time.Now()
+			b, err := io.ReadAll(r)
+			elapsed := time.Since(start)
+			r.Close()
+
+			if tt.stall {
+				if err == nil || !isTimeout(err) {
+					t.Errorf("stalled transfer: %v, want a timeout", err)
+				}
+				if elapsed > 2*time.Second {
+					t.Errorf("stalled transfer gave up after %s", elapsed)
+				}
+			} else if err != nil || string(b) != string(samplePdf) {
+				t.Errorf("transfer: %q, %v", b, err)
+			}
+			if !stub.received(tt.passive) || stub.received(tt.notPassive) {
+				t.Errorf("%s not used (or %s sent)", tt.passive, tt.notPassive)
+			}
+		})
+	}
+
+	t.Run("dial timeout", func(t *testing.T) {
+		// TEST-NET-1 isn't routed, the connect either fails or hangs
+		cfg := Config{ftpDialTimeout: 300 * time.Millisecond, ftpOpTimeout: time.Second}
+		start := time.Now()
+		c, err := ftp.Dial("192.0.2.1:21", ftpDialOptions(&cfg)...)
+		if err == nil {
+			c.Quit()
+			t.Fatal("dial to an unrouted address succeeded")
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("dial gave up after %s, want about %s", elapsed, cfg.ftpDialTimeout)
+		}
+	})
+}
+
+func TestBarcodeConcurrentWrites(t *testing.T) {
+	srv, handler := newTestHandler(t)
+	path := filepath.Join(srv.cfg().directory, "SCC1165613.png")
+
+	// readers never see a partial file while the writers replace it
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	var reads int64
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				b, err := os.ReadFile(path)
+				if os.IsNotExist(err) {
+					continue
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := png.Decode(bytes.NewReader(b)); err != nil {
+					t.Errorf("read %d bytes that don't decode: %v", len(b), err)
+					return
+				}
+				atomic.AddInt64(&reads, 1)
+			}
+		}()
+	}
+
+	var writers sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			for j := 0; j < 5; j++ {
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sampleIdToBarCode?key=SCC1165613&force=true", nil))
+				if rec.Code != http.StatusOK {
+					t.Errorf("status %d: %s", rec.Code, rec.Body)
+					return
+				}
+			}
+		}()
+	}
+	writers.Wait()
+	close(stop)
+	readers.Wait()
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := png.Decode(bytes.NewReader(b)); err != nil {
+		t.Errorf("final file doesn't decode: %v", err)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(srv.cfg().directory, tempFilePrefix+"*")); len(matches) > 0 {
+		t.Errorf("temp files left behind: %v", matches)
+	}
+	t.Logf("%d concurrent reads decoded", atomic.LoadInt64(&reads))
+}
+
+func TestFtpNameTemplate(t *testing.T) {
+	for _, text := range []string{"{{.Key}}{{.Ext}}", "ATT_{{.Key}}_v2{{.Ext}}", "ATT_{{.Key}}_v2.pdf", "{{.Key}}.PDF"} {
+		if _, err := parseFtpNameTemplate(text); err != nil {
+			t.Errorf("parseFtpNameTemplate(%q): %v", text, err)
+		}
+	}
+	for _, text := range []string{"", "archive.pdf", "{{.Ext}}", "{{.Key}", "{{.Name}}.pdf", "dir/{{.Key}}.pdf", `dir\{{.Key}}.pdf`} {
+		if _, err := parseFtpNameTemplate(text); err == nil {
+			t.Errorf("parseFtpNameTemplate(%q) accepted", text)
+		}
+	}
+
+	tests := []struct {
+		template string
+		remote   string
+		// listed : names on the archive and the key they give, "" when
+		// they aren't attestations
+		listed map[string]string
+	}{
+		{"", "WA46668.pdf", map[string]string{"WA46668.pdf": "WA46668", "WA46668.tif": ""}},
+		{"ATT_{{.Key}}{{.Ext}}", "ATT_WA46668.pdf", map[string]string{"ATT_WA46668.pdf": "WA46668", "WA46668.pdf": "", "ATT_.pdf": ""}},
+		{"{{.Key}}_v2{{.Ext}}", "WA46668_v2.pdf", map[string]string{"WA46668_v2.pdf": "WA46668", "WA46668.pdf": "", "_v2.pdf": ""}},
+		{"ATT_{{.Key}}_v2.pdf", "ATT_WA46668_v2.pdf", map[string]string{"ATT_WA46668_v2.pdf": "WA46668", "ATT_WA46668_v3.pdf": ""}},
+	}
+	for _, tt := range tests {
+		cfg := &Config{}
+		if tt.template != "" {
+			tmpl, err := parseFtpNameTemplate(tt.template)
+			if err != nil {
+				t.Fatalf("parseFtpNameTemplate(%q): %v", tt.template, err)
+			}
+			cfg.ftpNameTmpl = tmpl
+		}
+		srv, err := newServer(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := srv.ftpRemoteName("WA46668.pdf"); got != tt.remote {
+			t.Errorf("%q: ftpRemoteName = %q, want %q", tt.template, got, tt.remote)
+		}
+		for name, want := range tt.listed {
+			key, ok := srv.ftpKey(name, ".pdf")
+			if ok != (want != "") || key != want {
+				t.Errorf("%q: ftpKey(%q) = %q, %v, want %q", tt.template, name, key, ok, want)
+			}
+		}
+	}
+}
+
+func TestAttestationFtpNameTemplate(t *testing.T) {
+	ftpd := newFtpStub(t, map[string][]byte{"ATT_WA46668_v2.pdf": samplePdf})
+	ts := newTestServer(t, "-srvFtp", ftpd.addr(), "-ftpNameTemplate", "ATT_{{.Key}}_v2{{.Ext}}")
+
+	resp, body := get(t, ts, "/attestation?key=WA46668")
+	if resp.StatusCode != http.StatusOK || string(body) != string(samplePdf) {
+		t.Fatalf("%d %q", resp.StatusCode, body)
+	}
+	if _, err := os.Stat(filepath.Join(ts.directory(), "WA46668.pdf")); err != nil {
+		t.Errorf("not cached under the key: %v", err)
+	}
+
+	if _, err := parseConfig([]string{"-ftpNameTemplate", "archive.pdf"}); err == nil {
+		t.Error("constant template accepted at startup")
+	}
+}
+
+func TestBarcodeContentType(t *testing.T) {
+	// the memory cache answers with the image instead of its location
+	ts := newTestServer(t, "-barcodeCacheBytes", "1048576")
+
+	tests := []struct {
+		query  string
+		status int
+		want   string
+	}{
+		{"/sampleIdToBarCode?key=SCC1165613", http.StatusOK, "image/png"},
+		{"/sampleIdToBarCode?key=SCC1165613&format=png", http.StatusOK, "image/png"},
+		{"/sampleIdToBarCode?key=SCC1165613&format=jpeg", http.StatusOK, "image/jpeg"},
+		{"/sampleIdToBarCode?key=SCC1165613&format=gif", http.StatusOK, "image/gif"},
+		{"/sampleIdToBarCode?key=SCC1165613&format=svg", http.StatusOK, "image/svg+xml"},
+		{"/sampleIdToBarCode?key=SCC1165613&contentType=application/octet-stream", http.StatusOK, "application/octet-stream"},
+		{"/sampleIdToBarCode?key=SCC1165613&contentType=image/x-png", http.StatusOK, "image/x-png"},
+		{"/sampleIdToBarCode?key=SCC1165613&format=svg&contentType=image/svg%2Bxml", http.StatusOK, "image/svg+xml"},
+		{"/sampleIdToQrCode?key=WA46668", http.StatusOK, "image/png"},
+		{"/sampleIdToQrCode?key=WA46668&contentType=application/octet-stream", http.StatusOK, "application/octet-stream"},
+		{"/sampleIdToBarCode?key=SCC1165613&contentType=text/html", http.StatusBadRequest, ""},
+		{"/sampleIdToBarCode?key=SCC1165613&contentType=image/svg%2Bxml", http.StatusBadRequest, ""},
+		{"/sampleIdToBarCode?key=SCC1165613&contentType=%3B%3B", http.StatusBadRequest, ""},
+		{"/sampleIdToQrCode?key=WA46668&contentType=text/plain", http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		resp, body := get(t, ts, tt.query)
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.query, resp.StatusCode, tt.status, body)
+			continue
+		}
+		if tt.want != "" && resp.Header.Get("Content-Type") != tt.want {
+			t.Errorf("%s: Content-Type %q, want %q", tt.query, resp.Header.Get("Content-Type"), tt.want)
+		}
+	}
+}
+
+// throttledReader : r delivered one Read at a time with a fixed latency,
+// like a data connection where every call waits for the network
+type throttledReader struct {
+	r       io.Reader
+	latency time.Duration
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	time.Sleep(t.latency)
+	return t.r.Read(p)
+}
+
+func BenchmarkStoreDocument(b *testing.B) {
+	data := bytes.Repeat([]byte("%PDF-1.4 stub attestation "), 1<<20/26)
+
+	for _, size := range []int{minCopyBufferSize, 32 << 10, 256 << 10, 1 << 20} {
+		b.Run(strconv.Itoa(size>>10)+"KB", func(b *testing.B) {
+			srv, _ := newTestHandler(b, "-copyBufferSize", strconv.Itoa(size))
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				r := &throttledReader{r: bytes.NewReader(data), latency: 20 * time.Microsecond}
+				if _, err := srv.storeDocument(srv.cfg().directory, "WA46668.pdf", r); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkPngCompression(b *testing.B) {
+	bc, err := code128.Encode("SCC1165613")
+	if err != nil {
+		b.Fatal(err)
+	}
+	scaled, err := barcode.Scale(bc, 800, 200)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, name := range []string{"none", "speed", "default", "best"} {
+		b.Run(name, func(b *testing.B) {
+			cfg, err := parseConfig([]string{"-pngCompression", name})
+			if err != nil {
+				b.Fatal(err)
+			}
+			encoder := &png.Encoder{CompressionLevel: cfg.pngCompression}
+			var buf bytes.Buffer
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				buf.Reset()
+				if err := encoder.Encode(&buf, scaled); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(buf.Len()), "bytes")
+		})
+	}
+}
+
+func TestConcurrentFetchesShareRetr(t *testing.T) {
+	keys := []string{"WA46668", "WA46669", "WA46670"}
+	files := make(map[string][]byte)
+	for _, key := range keys {
+		files[key+".pdf"] = samplePdf
+	}
+	ftpd := newFtpStub(t, files)
+	// long enough for every request to join the fetch
+	ftpd.delay = 200 * time.Millisecond
+	ts := newTestServer(t, "-srvFtp", ftpd.addr())
+
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, key := range keys {
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(key string) {
+				defer wg.Done()
+				<-start
+				resp, err := http.Get(ts.URL + "/attestation?key=" + key)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					t.Errorf("%s: status %d", key, resp.StatusCode)
+				}
+			}(key)
+		}
+	}
+	close(start)
+	wg.Wait()
+
+	for _, key := range keys {
+		if n := ftpd.retrCount(key + ".pdf"); n != 1 {
+			t.Errorf("%s: %d RETR sent, want 1", key, n)
+		}
+	}
+}
+
+func TestAttestationContentType(t *testing.T) {
+	ftpd := newFtpStub(t, map[string][]byte{"WA46669.pdf": samplePdf})
+	ts := newTestServer(t, "-srvFtp", ftpd.addr())
+	if err := os.WriteFile(filepath.Join(ts.directory(), "WA46668.pdf"), samplePdf, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// cached, then retrieved from the archive
+	for _, key := range []string{"WA46668", "WA46669"} {
+		resp, body := get(t, ts, "/attestation?key="+key)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", key, resp.StatusCode, body)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "application/pdf" {
+			t.Errorf("%s: Content-Type %q, want application/pdf", key, ct)
+		}
+		if cd := resp.Header.Get("Content-Disposition"); cd != "inline; filename="+key+".pdf" {
+			t.Errorf("%s: Content-Disposition %q", key, cd)
+		}
+	}
+}
+
+func TestValidateListenAddr(t *testing.T) {
+	for _, addr := range []string{":5000", "0.0.0.0:5000", "localhost:0", "[::1]:5000", ":65535", "unix:/run/vetsheet.sock"} {
+		if err := validateListenAddr(addr); err != nil {
+			t.Errorf("validateListenAddr(%q): %v", addr, err)
+		}
+	}
+	for _, addr := range []string{"", "5000", "localhost", ":", ":http", ":-1", ":65536", "::1:5000", "[::1]", "unix:", "host:50:00"} {
+		if err := validateListenAddr(addr); err == nil {
+			t.Errorf("validateListenAddr(%q) accepted", addr)
+		}
+	}
+	if _, err := parseConfig([]string{"-listen-addr", "5000"}); err == nil {
+		t.Error("parseConfig accepted -listen-addr=5000")
+	}
+}
+
+func TestAllowMethods(t *testing.T) {
+	ts := newTestServer(t)
+
+	tests := []struct {
+		method, path string
+		status       int
+		allow        string
+	}{
+		{http.MethodGet, "/healthz", http.StatusOK, ""},
+		{http.MethodHead, "/healthz", http.StatusOK, ""},
+		{http.MethodHead, "/sampleIdToBarCode?key=SCC1165613", http.StatusOK, ""},
+		{http.MethodPost, "/healthz", http.StatusMethodNotAllowed, "GET, HEAD"},
+		{http.MethodDelete, "/attestation?key=WA46668", http.StatusMethodNotAllowed, "GET, HEAD"},
+		{http.MethodPut, "/sampleIdToBarCode?key=SCC1165613", http.StatusMethodNotAllowed, "GET, HEAD"},
+		{http.MethodGet, "/barcode/decode", http.StatusMethodNotAllowed, "POST"},
+		{http.MethodHead, "/barcode/decode", http.StatusMethodNotAllowed, "POST"},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, ts.URL+tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.path, resp.StatusCode, tt.status)
+		}
+		if allow := resp.Header.Get("Allow"); allow != tt.allow {
+			t.Errorf("%s %s: Allow %q, want %q", tt.method, tt.path, allow, tt.allow)
+		}
+	}
+}
+
+func TestCheckServable(t *testing.T) {
+	ts := newTestServer(t)
+	directory := ts.directory()
+	outside := filepath.Join(t.TempDir(), "secret.pdf")
+	if err := os.WriteFile(outside, []byte("%PDF-1.4 secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(directory, "WA46668.pdf"), samplePdf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(directory, "WA46668.pdf"), filepath.Join(directory, "WA46671.pdf")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(directory, "WA46669.pdf")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(directory, "WA46670.pdf"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]bool{
+		"WA46668.pdf": true,  // regular file
+		"WA46671.pdf": true,  // symlink staying inside directory
+		"WA46669.pdf": false, // symlink escaping directory
+		"WA46670.pdf": false, // directory named like an attestation
+		"WA00000.pdf": false, // missing
+	}
+	for name, ok := range tests {
+		if err := checkServable(directory, filepath.Join(directory, name)); (err == nil) != ok {
+			t.Errorf("checkServable(%s) = %v, want ok %v", name, err, ok)
+		}
+	}
+
+	for _, key := range []string{"WA46669", "WA46670"} {
+		resp, body := get(t, ts, "/attestation?key="+key)
+		if resp.StatusCode != http.StatusNotFound || strings.Contains(string(body), "secret") {
+			t.Errorf("%s: status %d, body %q, want 404", key, resp.StatusCode, body)
+		}
+	}
+}
+
+func TestInvalidKeys(t *testing.T) {
+	ts := newTestServer(t)
+
+	for _, key := range []string{"../WA46668", "..", "a/b", `a\b`, "WA46668\x00", "WA..46668", "WA46668\r\nINFO forged", "WA46668\n", "WA\x1b[2J", "WA\u0085"} {
+		if validKey(key) {
+			t.Errorf("validKey(%q) accepted", key)
+		}
+		escaped := url.QueryEscape(key)
+		for _, path := range []string{
+			"/attestation?key=", "/attestation/exists?key=", "/attestation/bundle?key=", "/attestation/preview?key=",
+			"/attestation/images?key=", "/attestation/merge?keys=WA46668,", "/sampleIdToBarCode?key=", "/sampleIdToQrCode?key=",
+		} {
+			if resp, _ := get(t, ts, path+escaped); resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("%s%q: status %d, want 400", path, key, resp.StatusCode)
+			}
+		}
+	}
+	for _, key := range []string{"WA46668", "SCC1165613", "PARTNER-123", "étiquette"} {
+		if !validKey(key) {
+			t.Errorf("validKey(%q) rejected", key)
+		}
+	}
+
+	// keys reaching the archive can't make the download land elsewhere
+	parent := filepath.Dir(ts.directory())
+	if _, err := ts.srv.storeDocument(ts.directory(), "../escaped.pdf", bytes.NewReader(samplePdf)); err == nil {
+		t.Error("storeDocument wrote outside of directory")
+	}
+	if _, err := os.Stat(filepath.Join(parent, "escaped.pdf")); err == nil {
+		t.Error("escaped.pdf created next to directory")
+	}
+}
+
+func TestDocumentExtensions(t *testing.T) {
+	ftpd := newFtpStub(t, map[string][]byte{"WA46669.tif": []byte("II*\x00archived")})
+	ts := newTestServer(t, "-srvFtp", ftpd.addr(), "-documentExtensions", ".pdf,.tif")
+	tif := []byte("II*\x00local")
+	if err := os.WriteFile(filepath.Join(ts.directory(), "WA46668.tif"), tif, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct{ key, source string }{{"WA46668", "local"}, {"WA46669", "archive"}} {
+		resp, body := get(t, ts, "/attestation/exists?key="+tc.key)
+		if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), `"source":"`+tc.source+`"`) {
+			t.Errorf("exists %s: %d %s, want 200 from %s", tc.key, resp.StatusCode, body, tc.source)
+		}
+	}
+
+	resp, body := get(t, ts, "/attestation/bundle?key=WA46668")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("bundle: status %d: %s", resp.StatusCode, body)
+	}
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	part, err := multipart.NewReader(bytes.NewReader(body), params["boundary"]).NextPart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(part)
+	if part.FileName() != "WA46668.tif" || part.Header.Get("Content-Type") != "image/tiff" || !bytes.Equal(data, tif) {
+		t.Errorf("bundle part %q %q %q, want the local tif", part.FileName(), part.Header.Get("Content-Type"), data)
+	}
+
+	// pdfcpu only reads pdfs
+	for _, path := range []string{"/attestation/preview?key=WA46668", "/attestation/merge?keys=WA46668"} {
+		if resp, _ := get(t, ts, path); resp.StatusCode != http.StatusUnsupportedMediaType {
+			t.Errorf("%s: status %d, want 415", path, resp.StatusCode)
+		}
+	}
+}
+
+func TestBundleResolvesKey(t *testing.T) {
+	srv, handler := newTestHandler(t)
+	if err := os.WriteFile(filepath.Join(srv.cfg().directory, "WA46668.pdf"), samplePdf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	keys := filepath.Join(t.TempDir(), "keys.csv")
+	if err := os.WriteFile(keys, []byte("PARTNER-123,WA46668\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.loadKeyMap(keys); err != nil {
+		t.Fatal(err)
+	}
+	trail := filepath.Join(t.TempDir(), "audit.log")
+	var err error
+	if srv.auditLog, err = openAuditLog(trail); err != nil {
+		t.Fatal(err)
+	}
+	ts := &testServer{Server: httptest.NewServer(handler), srv: srv}
+	t.Cleanup(ts.Close)
+
+	resp, body := get(t, ts, "/attestation/bundle?key=PARTNER-123&keyType=partner")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Warning") != "" {
+		t.Fatalf("partner key: status %d, Warning %q", resp.StatusCode, resp.Header.Get("Warning"))
+	}
+	if !bytes.Contains(body, samplePdf) || !bytes.Contains(body, []byte(`filename=WA46668.pdf`)) {
+		t.Error("bundle doesn't carry the pdf of the translated key")
+	}
+	entry, err := os.ReadFile(trail)
+	if err != nil || !strings.Contains(string(entry), `"key":"WA46668"`) || !strings.Contains(string(entry), fmt.Sprintf(`"bytes":%d`, len(samplePdf))) {
+		t.Errorf("audit trail %q (%v), want the translated key and the pdf size", entry, err)
+	}
+
+	if resp, _ := get(t, ts, "/attestation/bundle?key=UNKNOWN&keyType=partner"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("unknown partner key: status %d, want 404", resp.StatusCode)
+	}
+	if resp, _ := get(t, ts, "/attestation/bundle?key=WA46668&exp=1&sig=00"); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("bad signature: status %d, want 403", resp.StatusCode)
+	}
+}